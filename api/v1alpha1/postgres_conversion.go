@@ -0,0 +1,263 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// conversionDataAnnotation keeps the v1beta1 fields that v1alpha1 cannot represent, so that an
+// object read and written back through v1alpha1 does not lose them
+const conversionDataAnnotation = "postgres.snappcloud.io/conversion-data"
+
+// conversionData is the content of conversionDataAnnotation
+type conversionData struct {
+	UpgradeStrategy  v1beta1.UpgradeStrategy       `json:"upgradeStrategy,omitempty"`
+	UpgradeImage     string                        `json:"upgradeImage,omitempty"`
+	Image            string                        `json:"image,omitempty"`
+	ImageCatalogRef  *v1beta1.ImageCatalogRef      `json:"imageCatalogRef,omitempty"`
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	Scheduling       *v1beta1.Scheduling           `json:"scheduling,omitempty"`
+	Disruption       v1beta1.DisruptionSpec        `json:"disruption,omitempty"`
+	Security         v1beta1.SecuritySpec          `json:"security,omitempty"`
+	NetworkPolicy    *v1beta1.NetworkPolicy        `json:"networkPolicy,omitempty"`
+	StatusImage      string                        `json:"statusImage,omitempty"`
+	Conditions       []metav1.Condition            `json:"conditions,omitempty"`
+	Upgrade          *v1beta1.UpgradeStatus        `json:"upgrade,omitempty"`
+}
+
+// empty reports whether there is nothing to keep in the annotation
+func (d *conversionData) empty() bool {
+	return d.UpgradeStrategy == "" && d.UpgradeImage == "" && d.Image == "" && d.ImageCatalogRef == nil && len(d.ImagePullSecrets) == 0 &&
+		d.Scheduling == nil && d.Disruption == (v1beta1.DisruptionSpec{}) &&
+		d.Security == (v1beta1.SecuritySpec{}) && d.NetworkPolicy == nil && d.StatusImage == "" && len(d.Conditions) == 0 && d.Upgrade == nil
+}
+
+// ConvertTo converts this Postgres to the v1beta1 hub version
+func (src *Postgres) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.Postgres)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = v1beta1.PostgresSpec{
+		PostgreSQL: v1beta1.PostgreSQLSpec{
+			Version:    src.Spec.Version,
+			Parameters: src.Spec.Parameters,
+		},
+		Storage:    v1beta1.StorageSpec{Size: src.Spec.Persistence.Size},
+		Auth:       v1beta1.Auth(src.Spec.Auth),
+		Resources:  src.Spec.Resources,
+		Probes:     probesToHub(src.Spec.Probes),
+		TLS:        tlsToHub(src.Spec.TLS),
+		Pooler:     poolerToHub(src.Spec.Pooler),
+		Monitoring: monitoringToHub(src.Spec.Monitoring),
+		Deletion: v1beta1.DeletionSpec{
+			Policy:                  v1beta1.DeletionPolicy(src.Spec.DeletionPolicy),
+			Protection:              src.Spec.DeletionProtection,
+			VolumeSnapshotClassName: src.Spec.VolumeSnapshotClassName,
+		},
+	}
+	dst.Status = v1beta1.PostgresStatus{
+		Ready:                src.Status.Ready,
+		Phase:                v1beta1.PostgresPhase(src.Status.Phase),
+		Version:              src.Status.Version,
+		CurrentPrimary:       src.Status.CurrentPrimary,
+		CurrentPrimaryUID:    src.Status.CurrentPrimaryUID,
+		LastSuccessfulBackup: src.Status.LastSuccessfulBackup,
+	}
+
+	raw, ok := dst.Annotations[conversionDataAnnotation]
+	if !ok {
+		return nil
+	}
+	var data conversionData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return err
+	}
+	dst.Spec.PostgreSQL.UpgradeStrategy = data.UpgradeStrategy
+	dst.Spec.PostgreSQL.UpgradeImage = data.UpgradeImage
+	dst.Spec.Image = data.Image
+	dst.Spec.ImageCatalogRef = data.ImageCatalogRef
+	dst.Spec.ImagePullSecrets = data.ImagePullSecrets
+	dst.Spec.Scheduling = data.Scheduling
+	dst.Spec.Disruption = data.Disruption
+	dst.Spec.Security = data.Security
+	dst.Spec.NetworkPolicy = data.NetworkPolicy
+	dst.Status.Image = data.StatusImage
+	dst.Status.Conditions = data.Conditions
+	dst.Status.Upgrade = data.Upgrade
+	delete(dst.Annotations, conversionDataAnnotation)
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+	return nil
+}
+
+// ConvertFrom converts from the v1beta1 hub version to this version
+func (dst *Postgres) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.Postgres)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = PostgresSpec{
+		Version:                 src.Spec.PostgreSQL.Version,
+		Persistence:             Persistence{Size: src.Spec.Storage.Size},
+		Auth:                    Auth(src.Spec.Auth),
+		Resources:               src.Spec.Resources,
+		Probes:                  probesFromHub(src.Spec.Probes),
+		TLS:                     tlsFromHub(src.Spec.TLS),
+		Pooler:                  poolerFromHub(src.Spec.Pooler),
+		Monitoring:              monitoringFromHub(src.Spec.Monitoring),
+		Parameters:              src.Spec.PostgreSQL.Parameters,
+		DeletionPolicy:          DeletionPolicy(src.Spec.Deletion.Policy),
+		DeletionProtection:      src.Spec.Deletion.Protection,
+		VolumeSnapshotClassName: src.Spec.Deletion.VolumeSnapshotClassName,
+	}
+	dst.Status = PostgresStatus{
+		Ready:                src.Status.Ready,
+		Phase:                PostgresPhase(src.Status.Phase),
+		Version:              src.Status.Version,
+		CurrentPrimary:       src.Status.CurrentPrimary,
+		CurrentPrimaryUID:    src.Status.CurrentPrimaryUID,
+		LastSuccessfulBackup: src.Status.LastSuccessfulBackup,
+	}
+
+	data := conversionData{
+		UpgradeStrategy:  src.Spec.PostgreSQL.UpgradeStrategy,
+		UpgradeImage:     src.Spec.PostgreSQL.UpgradeImage,
+		Image:            src.Spec.Image,
+		ImageCatalogRef:  src.Spec.ImageCatalogRef,
+		ImagePullSecrets: src.Spec.ImagePullSecrets,
+		Scheduling:       src.Spec.Scheduling,
+		Disruption:       src.Spec.Disruption,
+		Security:         src.Spec.Security,
+		NetworkPolicy:    src.Spec.NetworkPolicy,
+		StatusImage:      src.Status.Image,
+		Conditions:       src.Status.Conditions,
+		Upgrade:          src.Status.Upgrade,
+	}
+	if data.empty() {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[conversionDataAnnotation] = string(raw)
+	return nil
+}
+
+func probesToHub(in *Probes) *v1beta1.Probes {
+	if in == nil {
+		return nil
+	}
+	return &v1beta1.Probes{
+		Startup:   (*v1beta1.ProbeTiming)(in.Startup),
+		Liveness:  (*v1beta1.ProbeTiming)(in.Liveness),
+		Readiness: (*v1beta1.ProbeTiming)(in.Readiness),
+	}
+}
+
+func probesFromHub(in *v1beta1.Probes) *Probes {
+	if in == nil {
+		return nil
+	}
+	return &Probes{
+		Startup:   (*ProbeTiming)(in.Startup),
+		Liveness:  (*ProbeTiming)(in.Liveness),
+		Readiness: (*ProbeTiming)(in.Readiness),
+	}
+}
+
+func tlsToHub(in *TLS) *v1beta1.TLS {
+	if in == nil {
+		return nil
+	}
+	out := &v1beta1.TLS{
+		Mode:      v1beta1.TLSMode(in.Mode),
+		SecretRef: in.SecretRef,
+		Enforce:   in.Enforce,
+	}
+	if in.ClientCertificates != nil {
+		out.ClientCertificates = make([]v1beta1.ClientCertificate, len(in.ClientCertificates))
+		for i, cert := range in.ClientCertificates {
+			out.ClientCertificates[i] = v1beta1.ClientCertificate(cert)
+		}
+	}
+	return out
+}
+
+func tlsFromHub(in *v1beta1.TLS) *TLS {
+	if in == nil {
+		return nil
+	}
+	out := &TLS{
+		Mode:      TLSMode(in.Mode),
+		SecretRef: in.SecretRef,
+		Enforce:   in.Enforce,
+	}
+	if in.ClientCertificates != nil {
+		out.ClientCertificates = make([]ClientCertificate, len(in.ClientCertificates))
+		for i, cert := range in.ClientCertificates {
+			out.ClientCertificates[i] = ClientCertificate(cert)
+		}
+	}
+	return out
+}
+
+func poolerToHub(in *Pooler) *v1beta1.Pooler {
+	if in == nil {
+		return nil
+	}
+	return &v1beta1.Pooler{
+		Enabled:         in.Enabled,
+		Replicas:        in.Replicas,
+		PoolMode:        v1beta1.PoolMode(in.PoolMode),
+		DefaultPoolSize: in.DefaultPoolSize,
+		MaxClientConn:   in.MaxClientConn,
+		Image:           in.Image,
+	}
+}
+
+func poolerFromHub(in *v1beta1.Pooler) *Pooler {
+	if in == nil {
+		return nil
+	}
+	return &Pooler{
+		Enabled:         in.Enabled,
+		Replicas:        in.Replicas,
+		PoolMode:        PoolMode(in.PoolMode),
+		DefaultPoolSize: in.DefaultPoolSize,
+		MaxClientConn:   in.MaxClientConn,
+		Image:           in.Image,
+	}
+}
+
+func monitoringToHub(in *Monitoring) *v1beta1.Monitoring {
+	if in == nil {
+		return nil
+	}
+	return &v1beta1.Monitoring{
+		Enabled:       in.Enabled,
+		Image:         in.Image,
+		CustomQueries: in.CustomQueries,
+		Alerts:        (*v1beta1.Alerts)(in.Alerts),
+	}
+}
+
+func monitoringFromHub(in *v1beta1.Monitoring) *Monitoring {
+	if in == nil {
+		return nil
+	}
+	return &Monitoring{
+		Enabled:       in.Enabled,
+		Image:         in.Image,
+		CustomQueries: in.CustomQueries,
+		Alerts:        (*Alerts)(in.Alerts),
+	}
+}
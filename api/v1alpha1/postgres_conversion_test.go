@@ -0,0 +1,79 @@
+package v1alpha1
+
+import (
+	"time"
+
+	fuzz "github.com/google/gofuzz"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// conversionFuzzer fills objects with random values that survive a JSON round trip, the stashed
+// conditions are stored as JSON
+func conversionFuzzer() *fuzz.Fuzzer {
+	return fuzz.New().NilChance(0.2).Funcs(
+		func(q *resource.Quantity, c fuzz.Continue) {
+			*q = *resource.NewQuantity(c.Int63n(1<<40), resource.BinarySI)
+		},
+		func(t *metav1.Time, c fuzz.Continue) {
+			*t = metav1.NewTime(time.Unix(c.Int63n(1<<32), 0).UTC())
+		},
+	)
+}
+
+var _ = Describe("Postgres conversion", func() {
+	It("should round trip v1alpha1 through the hub", func() {
+		f := conversionFuzzer()
+		for i := 0; i < 1000; i++ {
+			original := &Postgres{}
+			f.Fuzz(original)
+			// the apiVersion and kind are set by the caller of the conversion
+			original.TypeMeta = metav1.TypeMeta{}
+
+			hub := &v1beta1.Postgres{}
+			Expect(original.DeepCopy().ConvertTo(hub)).To(Succeed())
+			restored := &Postgres{}
+			Expect(restored.ConvertFrom(hub)).To(Succeed())
+
+			Expect(equality.Semantic.DeepEqual(original, restored)).To(BeTrue(), "%#v != %#v", original, restored)
+		}
+	})
+
+	It("should round trip the hub through v1alpha1", func() {
+		f := conversionFuzzer()
+		for i := 0; i < 1000; i++ {
+			original := &v1beta1.Postgres{}
+			f.Fuzz(original)
+			original.TypeMeta = metav1.TypeMeta{}
+
+			spoke := &Postgres{}
+			Expect(spoke.ConvertFrom(original.DeepCopy())).To(Succeed())
+			restored := &v1beta1.Postgres{}
+			Expect(spoke.ConvertTo(restored)).To(Succeed())
+
+			Expect(equality.Semantic.DeepEqual(original, restored)).To(BeTrue(), "%#v != %#v", original, restored)
+		}
+	})
+
+	It("should keep the conditions in an annotation", func() {
+		hub := &v1beta1.Postgres{Status: v1beta1.PostgresStatus{Conditions: []metav1.Condition{{
+			Type:   v1beta1.ConditionReady,
+			Status: metav1.ConditionTrue,
+			Reason: "PodsReady",
+		}}}}
+
+		spoke := &Postgres{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		Expect(spoke.Annotations).To(HaveKey(conversionDataAnnotation))
+
+		restored := &v1beta1.Postgres{}
+		Expect(spoke.ConvertTo(restored)).To(Succeed())
+		Expect(restored.Annotations).NotTo(HaveKey(conversionDataAnnotation))
+		Expect(restored.Status.Conditions).To(Equal(hub.Status.Conditions))
+	})
+})
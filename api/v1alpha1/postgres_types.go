@@ -2,30 +2,258 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type PostgresSpec struct {
-	Version     string      `json:"version"`
-	Persistence Persistence `json:"persistence"`
-	Auth        Auth        `json:"auth"`
+	// Version is the tag of the postgres image. Defaults to the current major version.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +optional
+	Persistence Persistence `json:"persistence,omitempty"`
+	// +optional
+	Auth Auth `json:"auth,omitempty"`
+	// Resources of the postgres container. Defaults to 250m CPU and 512Mi memory.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Probes tunes the timing of the postgres container probes
+	// +optional
+	Probes *Probes `json:"probes,omitempty"`
+	// TLS enables encrypted server connections
+	// +optional
+	TLS *TLS `json:"tls,omitempty"`
+	// Pooler runs PgBouncer in front of the instance
+	// +optional
+	Pooler *Pooler `json:"pooler,omitempty"`
+	// Monitoring runs a postgres_exporter sidecar
+	// +optional
+	Monitoring *Monitoring `json:"monitoring,omitempty"`
+	// Parameters are postgresql.conf settings passed to the server. Settings managed by the
+	// operator, such as ssl and hba_file, cannot be set.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// DeletionPolicy decides what happens to the data volumes when the Postgres object is deleted
+	// +kubebuilder:default=Retain
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// DeletionProtection rejects deleting the Postgres object, its StatefulSet and its data volumes
+	// until it is set to false again
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+	// VolumeSnapshotClassName is the class of the final VolumeSnapshot taken with deletion policy
+	// Snapshot. Defaults to the cluster default class.
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
 }
 
+// Probes holds the timing of the postgres container probes. The checks themselves are managed by
+// the operator: startup and readiness run pg_isready, liveness opens a TCP connection.
+type Probes struct {
+	// +optional
+	Startup *ProbeTiming `json:"startup,omitempty"`
+	// +optional
+	Liveness *ProbeTiming `json:"liveness,omitempty"`
+	// +optional
+	Readiness *ProbeTiming `json:"readiness,omitempty"`
+}
+
+type ProbeTiming struct {
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// DeletionPolicy selects how the data volumes are handled on deletion
+// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the data volumes together with the instance
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain keeps the data volumes, a new instance with the same name reuses them
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicySnapshot takes a VolumeSnapshot of every data volume and deletes the volumes
+	// once the snapshots are ready. The snapshots are not owned by the instance and are kept.
+	DeletionPolicySnapshot DeletionPolicy = "Snapshot"
+)
+
 type Persistence struct {
-	Size string `json:"size"`
+	// Size of the data volume. Defaults to 1Gi.
+	// +optional
+	Size string `json:"size,omitempty"`
 }
 
 type Auth struct {
-	Database  string `json:"database"`
-	SecretRef string `json:"secretRef"`
+	// Database is created on first start. Defaults to the name of the Postgres object.
+	// +optional
+	Database string `json:"database,omitempty"`
+	// SecretRef names the Secret holding the superuser credentials. Defaults to
+	// <name>-credentials, which the operator generates when it does not exist.
+	// +optional
+	SecretRef string `json:"secretRef,omitempty"`
+	// UsernameKey is the key holding the username in the referenced Secret. Defaults to "username".
+	// +optional
+	UsernameKey string `json:"usernameKey,omitempty"`
+	// PasswordKey is the key holding the password in the referenced Secret. Defaults to "password".
+	// +optional
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// TLSMode selects where the server certificate comes from
+// +kubebuilder:validation:Enum=operator;secretRef
+type TLSMode string
+
+const (
+	// TLSModeOperator makes the operator issue a self-signed CA and server certificate
+	TLSModeOperator TLSMode = "operator"
+	// TLSModeSecretRef uses a user supplied kubernetes.io/tls Secret
+	TLSModeSecretRef TLSMode = "secretRef"
+)
+
+type TLS struct {
+	Mode TLSMode `json:"mode"`
+	// SecretRef names the kubernetes.io/tls Secret used with mode secretRef
+	// +optional
+	SecretRef string `json:"secretRef,omitempty"`
+	// Enforce rejects remote connections that do not use SSL
+	// +optional
+	Enforce bool `json:"enforce,omitempty"`
+	// ClientCertificates lists roles that authenticate with a client certificate signed by
+	// the instance CA. Only supported with mode operator.
+	// +optional
+	ClientCertificates []ClientCertificate `json:"clientCertificates,omitempty"`
+}
+
+type ClientCertificate struct {
+	// Role is the database role the certificate authenticates as, it is created when missing
+	Role string `json:"role"`
+	// SecretName is the kubernetes.io/tls Secret the certificate is written to.
+	// Defaults to <name>-client-<role>.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
 }
 
+// PoolMode is the PgBouncer pool_mode
+// +kubebuilder:validation:Enum=session;transaction;statement
+type PoolMode string
+
+const (
+	PoolModeSession     PoolMode = "session"
+	PoolModeTransaction PoolMode = "transaction"
+	PoolModeStatement   PoolMode = "statement"
+)
+
+type Pooler struct {
+	Enabled bool `json:"enabled"`
+	// Replicas is the number of PgBouncer pods. Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// PoolMode defaults to transaction
+	// +optional
+	PoolMode PoolMode `json:"poolMode,omitempty"`
+	// DefaultPoolSize is the number of server connections per user and database. Defaults to 20.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	DefaultPoolSize int32 `json:"defaultPoolSize,omitempty"`
+	// MaxClientConn is the number of client connections accepted per pod. Defaults to 1000.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxClientConn int32 `json:"maxClientConn,omitempty"`
+	// Image overrides the PgBouncer image
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+type Monitoring struct {
+	Enabled bool `json:"enabled"`
+	// Image overrides the postgres_exporter image
+	// +optional
+	Image string `json:"image,omitempty"`
+	// CustomQueries references ConfigMap keys holding additional exporter queries. Each entry maps
+	// a metric name to its query, the value and label columns and the databases it runs in.
+	// +optional
+	CustomQueries []corev1.ConfigMapKeySelector `json:"customQueries,omitempty"`
+	// Alerts overrides the thresholds of the generated PrometheusRule
+	// +optional
+	Alerts *Alerts `json:"alerts,omitempty"`
+}
+
+// Alerts holds the thresholds of the default alerts. Unset fields use the documented defaults.
+type Alerts struct {
+	// ReplicationLagSeconds fires PostgresReplicationLag above this lag. Defaults to 300.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ReplicationLagSeconds int32 `json:"replicationLagSeconds,omitempty"`
+	// StorageUsagePercent fires PostgresStorageFull above this volume usage. Defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	StorageUsagePercent int32 `json:"storageUsagePercent,omitempty"`
+	// BackupMaxAgeHours fires PostgresBackupStale when the last successful backup is older. The
+	// operator only backs up before major upgrades, so the alert is left out unless this is set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	BackupMaxAgeHours int32 `json:"backupMaxAgeHours,omitempty"`
+	// ConnectionsPercent fires PostgresTooManyConnections above this share of max_connections. Defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	ConnectionsPercent int32 `json:"connectionsPercent,omitempty"`
+	// TransactionIDAge fires PostgresXIDWraparound when the oldest unfrozen transaction ID of a
+	// database is older. Defaults to 1500000000, wraparound happens at about 2100000000.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TransactionIDAge int64 `json:"transactionIDAge,omitempty"`
+}
+
+// PostgresPhase is a coarse summary of the instance lifecycle
+type PostgresPhase string
+
+const (
+	// PostgresPhaseCreating is set until the instance becomes ready for the first time
+	PostgresPhaseCreating PostgresPhase = "Creating"
+	PostgresPhaseReady    PostgresPhase = "Ready"
+	// PostgresPhaseNotReady is set when a previously ready instance stopped serving
+	PostgresPhaseNotReady PostgresPhase = "NotReady"
+	PostgresPhaseDeleting PostgresPhase = "Deleting"
+)
+
 type PostgresStatus struct {
 	Ready bool `json:"ready"`
+	// +optional
+	Phase PostgresPhase `json:"phase,omitempty"`
+	// Version is the version every pod of the instance runs, it follows spec version once a
+	// rolling update completed
+	// +optional
+	Version string `json:"version,omitempty"`
+	// CurrentPrimary is the pod serving the instance
+	// +optional
+	CurrentPrimary string `json:"currentPrimary,omitempty"`
+	// CurrentPrimaryUID is the UID of that pod, a change means the primary was replaced
+	// +optional
+	CurrentPrimaryUID string `json:"currentPrimaryUID,omitempty"`
+	// LastSuccessfulBackup is the time the latest VolumeSnapshots of the data volumes were ready.
+	// They are taken before every major version upgrade.
+	// +optional
+	LastSuccessfulBackup *metav1.Time `json:"lastSuccessfulBackup,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.version`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 type Postgres struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
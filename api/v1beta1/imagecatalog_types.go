@@ -0,0 +1,65 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageCatalogSpec lists the postgres images instances can run
+type ImageCatalogSpec struct {
+	// Images maps each supported major version to an image
+	// +kubebuilder:validation:MinItems=1
+	// +listType=map
+	// +listMapKey=major
+	Images []CatalogImage `json:"images"`
+}
+
+// CatalogImage is the image of one major version and what it ships besides the server
+type CatalogImage struct {
+	// Major is the major version the image runs, e.g. 16
+	// +kubebuilder:validation:Minimum=10
+	Major int `json:"major"`
+	// Image is the image reference, a tag or a digest, e.g. registry.example.com/postgis@sha256:...
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+	// Extensions are the libraries the image provides beyond the core server, e.g. postgis or
+	// timescaledb. Preloading a library that is not listed raises a warning Event.
+	// +optional
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// Image returns the catalog entry of major, or nil if the catalog does not support it
+func (s *ImageCatalogSpec) Image(major int) *CatalogImage {
+	for i := range s.Images {
+		if s.Images[i].Major == major {
+			return &s.Images[i]
+		}
+	}
+	return nil
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:storageversion
+
+// ImageCatalog maps the major versions of PostgreSQL to the images that run them. Postgres objects
+// reference a catalog with spec.imageCatalogRef, so hardened or extended images and pinned
+// digests are managed in one place.
+type ImageCatalog struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImageCatalogSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageCatalogList contains a list of ImageCatalog
+type ImageCatalogList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageCatalog `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageCatalog{}, &ImageCatalogList{})
+}
@@ -0,0 +1,518 @@
+// Define Go structs representing the Postgres CR.
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PostgresSpec groups the settings by the part of the deployment they configure
+type PostgresSpec struct {
+	// PostgreSQL configures the server
+	// +optional
+	PostgreSQL PostgreSQLSpec `json:"postgresql,omitempty"`
+	// Image overrides the postgres image of spec.postgresql.version, e.g. to pin a digest. It
+	// takes precedence over the image catalog.
+	// +optional
+	Image string `json:"image,omitempty"`
+	// ImageCatalogRef names the ImageCatalog the image of the major version is taken from. Without
+	// it the official postgres image tagged with the version is used.
+	// +optional
+	ImageCatalogRef *ImageCatalogRef `json:"imageCatalogRef,omitempty"`
+	// ImagePullSecrets are added to every pod of the instance, after the defaults of the operator
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Storage configures the data volume
+	// +optional
+	Storage StorageSpec `json:"storage,omitempty"`
+	// Auth configures the database and superuser created on first start
+	// +optional
+	Auth Auth `json:"auth,omitempty"`
+	// Resources of the postgres container. Defaults to 250m CPU and 512Mi memory. The memory limit
+	// sizes shared_buffers, effective_cache_size, work_mem and maintenance_work_mem unless they are
+	// set in spec.postgresql.parameters.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Scheduling places the pods of the instance on nodes
+	// +optional
+	Scheduling *Scheduling `json:"scheduling,omitempty"`
+	// Probes tunes the timing of the postgres container probes
+	// +optional
+	Probes *Probes `json:"probes,omitempty"`
+	// TLS enables encrypted server connections
+	// +optional
+	TLS *TLS `json:"tls,omitempty"`
+	// Pooler runs PgBouncer in front of the instance
+	// +optional
+	Pooler *Pooler `json:"pooler,omitempty"`
+	// Monitoring runs a postgres_exporter sidecar
+	// +optional
+	Monitoring *Monitoring `json:"monitoring,omitempty"`
+	// NetworkPolicy restricts the connections to the instance and its pooler to the listed clients
+	// +optional
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+	// Deletion decides what happens when the Postgres object is deleted
+	// +optional
+	Deletion DeletionSpec `json:"deletion,omitempty"`
+	// Disruption limits voluntary disruptions of the pods, such as node drains
+	// +optional
+	Disruption DisruptionSpec `json:"disruption,omitempty"`
+	// Security configures the security context of the pods
+	// +optional
+	Security SecuritySpec `json:"security,omitempty"`
+}
+
+// ImageCatalogRef references a cluster-scoped ImageCatalog
+type ImageCatalogRef struct {
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+type PostgreSQLSpec struct {
+	// Version is the tag of the postgres image. Defaults to the current major version.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// Parameters are postgresql.conf settings passed to the server. Settings managed by the
+	// operator, such as ssl and hba_file, cannot be set.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// UpgradeStrategy selects how major version upgrades are applied. Defaults to InPlace.
+	// +optional
+	UpgradeStrategy UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+	// UpgradeImage runs pg_upgrade in an in-place major version upgrade. It must contain the
+	// binaries of both versions under /usr/lib/postgresql/<major>/bin. {from} and {to} are replaced
+	// by the old and the new major version. Defaults to the --upgrade-image of the operator.
+	// +optional
+	UpgradeImage string `json:"upgradeImage,omitempty"`
+}
+
+// UpgradeStrategy selects how a major version upgrade is applied
+// +kubebuilder:validation:Enum=InPlace;BlueGreen
+type UpgradeStrategy string
+
+const (
+	// UpgradeStrategyInPlace stops the instance and runs pg_upgrade on its data volumes
+	UpgradeStrategyInPlace UpgradeStrategy = "InPlace"
+	// UpgradeStrategyBlueGreen provisions an instance of the new version next to the running one,
+	// copies the data with logical replication and switches the Service over on request. The
+	// running instance is restarted with wal_level=logical when this strategy is selected.
+	UpgradeStrategyBlueGreen UpgradeStrategy = "BlueGreen"
+)
+
+// UpgradeActionAnnotation triggers the next step of a blue/green upgrade. The operator removes it
+// once the action is taken.
+const UpgradeActionAnnotation = "postgres.snappcloud.io/upgrade-action"
+
+const (
+	// UpgradeActionCutover makes the running instance read-only, waits for the new instance to
+	// catch up and switches the Service over to it
+	UpgradeActionCutover = "cutover"
+	// UpgradeActionConfirm discards the old instance and moves the data volume of the new one over
+	UpgradeActionConfirm = "confirm"
+	// UpgradeActionAbort removes the new instance and makes the old one writable again. Writes
+	// made to the new instance after the cutover are lost.
+	UpgradeActionAbort = "abort"
+)
+
+// InstanceLabel names the instance on its StatefulSet and data volume claims. The deletion
+// protection webhook only receives the deletes of objects with this label.
+const InstanceLabel = "postgres.snappcloud.io/instance"
+
+// LegacyServiceAnnotation set to LegacyServiceRemove deletes the Service postgres-service that
+// instances created by earlier versions of the operator still own. Until then the operator keeps
+// it pointing to the instance and lists its names in the server certificate.
+const LegacyServiceAnnotation = "postgres.snappcloud.io/legacy-service"
+
+// LegacyServiceRemove is the value of LegacyServiceAnnotation that removes the legacy Service
+const LegacyServiceRemove = "remove"
+
+// Scheduling holds the pod scheduling settings of the instance. The pooler pods get the node
+// selector, tolerations, node affinity and priority class too.
+type Scheduling struct {
+	// NodeSelector restricts the pods to nodes with these labels, e.g. a dedicated node pool
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations let the pods run on tainted nodes
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity constrains the pods relative to nodes and other pods. The operator adds no pod
+	// anti-affinity of its own, instances run a single pod.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// TopologySpreadConstraints spread the pods of the instance, e.g. across zones
+	// +optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// PriorityClassName is the PriorityClass of the pods
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+}
+
+type DisruptionSpec struct {
+	// BlockPrimaryEviction keeps evictions, e.g. by a node drain or the cluster autoscaler, from
+	// stopping the primary. Drains of its node wait until it is turned off again.
+	// +optional
+	BlockPrimaryEviction bool `json:"blockPrimaryEviction,omitempty"`
+}
+
+type SecuritySpec struct {
+	// RunAsRoot starts the containers as their image defines, for images whose entrypoint needs
+	// root. By default the pods run as the postgres user (uid and gid 999) with a read-only root
+	// filesystem and pass the restricted Pod Security Standard, which they no longer do with it.
+	// +optional
+	RunAsRoot bool `json:"runAsRoot,omitempty"`
+}
+
+type StorageSpec struct {
+	// Size of the data volume. Defaults to 1Gi.
+	// +optional
+	Size string `json:"size,omitempty"`
+}
+
+type DeletionSpec struct {
+	// Policy decides what happens to the data volumes when the Postgres object is deleted
+	// +kubebuilder:default=Retain
+	// +optional
+	Policy DeletionPolicy `json:"policy,omitempty"`
+	// Protection rejects deleting the Postgres object, its StatefulSet and its data volumes
+	// until it is set to false again
+	// +optional
+	Protection bool `json:"protection,omitempty"`
+	// VolumeSnapshotClassName is the class of the final VolumeSnapshot taken with policy
+	// Snapshot. Defaults to the cluster default class.
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// Probes holds the timing of the postgres container probes. The checks themselves are managed by
+// the operator: startup and readiness run pg_isready, liveness opens a TCP connection.
+type Probes struct {
+	// +optional
+	Startup *ProbeTiming `json:"startup,omitempty"`
+	// +optional
+	Liveness *ProbeTiming `json:"liveness,omitempty"`
+	// +optional
+	Readiness *ProbeTiming `json:"readiness,omitempty"`
+}
+
+type ProbeTiming struct {
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// DeletionPolicy selects how the data volumes are handled on deletion
+// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the data volumes together with the instance
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain keeps the data volumes, a new instance with the same name reuses them
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicySnapshot takes a VolumeSnapshot of every data volume and deletes the volumes
+	// once the snapshots are ready. The snapshots are not owned by the instance and are kept.
+	DeletionPolicySnapshot DeletionPolicy = "Snapshot"
+)
+
+type Auth struct {
+	// Database is created on first start. Defaults to the name of the Postgres object.
+	// +optional
+	Database string `json:"database,omitempty"`
+	// SecretRef names the Secret holding the superuser credentials. Defaults to
+	// <name>-credentials, which the operator generates when it does not exist.
+	// +optional
+	SecretRef string `json:"secretRef,omitempty"`
+	// UsernameKey is the key holding the username in the referenced Secret. Defaults to "username".
+	// +optional
+	UsernameKey string `json:"usernameKey,omitempty"`
+	// PasswordKey is the key holding the password in the referenced Secret. Defaults to "password".
+	// +optional
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// TLSMode selects where the server certificate comes from
+// +kubebuilder:validation:Enum=operator;secretRef
+type TLSMode string
+
+const (
+	// TLSModeOperator makes the operator issue a self-signed CA and server certificate
+	TLSModeOperator TLSMode = "operator"
+	// TLSModeSecretRef uses a user supplied kubernetes.io/tls Secret
+	TLSModeSecretRef TLSMode = "secretRef"
+)
+
+type TLS struct {
+	Mode TLSMode `json:"mode"`
+	// SecretRef names the kubernetes.io/tls Secret used with mode secretRef
+	// +optional
+	SecretRef string `json:"secretRef,omitempty"`
+	// Enforce rejects remote connections that do not use SSL
+	// +optional
+	Enforce bool `json:"enforce,omitempty"`
+	// ClientCertificates lists roles that authenticate with a client certificate signed by
+	// the instance CA. Only supported with mode operator.
+	// +optional
+	ClientCertificates []ClientCertificate `json:"clientCertificates,omitempty"`
+}
+
+type ClientCertificate struct {
+	// Role is the database role the certificate authenticates as, it is created when missing
+	// +kubebuilder:validation:Pattern=`^[A-Za-z_][A-Za-z0-9_]*$`
+	// +kubebuilder:validation:MaxLength=63
+	Role string `json:"role"`
+	// SecretName is the kubernetes.io/tls Secret the certificate is written to.
+	// Defaults to <name>-client-<role>.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// PoolMode is the PgBouncer pool_mode
+// +kubebuilder:validation:Enum=session;transaction;statement
+type PoolMode string
+
+const (
+	PoolModeSession     PoolMode = "session"
+	PoolModeTransaction PoolMode = "transaction"
+	PoolModeStatement   PoolMode = "statement"
+)
+
+type Pooler struct {
+	Enabled bool `json:"enabled"`
+	// Replicas is the number of PgBouncer pods. Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// PoolMode defaults to transaction
+	// +optional
+	PoolMode PoolMode `json:"poolMode,omitempty"`
+	// DefaultPoolSize is the number of server connections per user and database. Defaults to 20.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	DefaultPoolSize int32 `json:"defaultPoolSize,omitempty"`
+	// MaxClientConn is the number of client connections accepted per pod. Defaults to 1000.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxClientConn int32 `json:"maxClientConn,omitempty"`
+	// Image overrides the PgBouncer image
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+type NetworkPolicy struct {
+	// Clients are the pods allowed to connect. The operator, the pods of the instance and its
+	// pooler are always allowed.
+	// +optional
+	Clients []NetworkPolicyClient `json:"clients,omitempty"`
+	// Scrapers are the pods allowed to scrape the exporter ports. Defaults to every pod in the
+	// --prometheus-namespace of the operator.
+	// +optional
+	Scrapers []NetworkPolicyClient `json:"scrapers,omitempty"`
+}
+
+// NetworkPolicyClient selects client pods like a NetworkPolicy peer. A namespaceSelector alone
+// allows every pod of the selected namespaces, a podSelector alone the selected pods in the
+// namespace of the instance.
+type NetworkPolicyClient struct {
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+type Monitoring struct {
+	Enabled bool `json:"enabled"`
+	// Image overrides the postgres_exporter image
+	// +optional
+	Image string `json:"image,omitempty"`
+	// CustomQueries references ConfigMap keys holding additional exporter queries. Each entry maps
+	// a metric name to its query, the value and label columns and the databases it runs in.
+	// +optional
+	CustomQueries []corev1.ConfigMapKeySelector `json:"customQueries,omitempty"`
+	// Alerts overrides the thresholds of the generated PrometheusRule
+	// +optional
+	Alerts *Alerts `json:"alerts,omitempty"`
+}
+
+// Alerts holds the thresholds of the default alerts. Unset fields use the documented defaults.
+type Alerts struct {
+	// ReplicationLagSeconds fires PostgresReplicationLag above this lag. Defaults to 300.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ReplicationLagSeconds int32 `json:"replicationLagSeconds,omitempty"`
+	// StorageUsagePercent fires PostgresStorageFull above this volume usage. Defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	StorageUsagePercent int32 `json:"storageUsagePercent,omitempty"`
+	// BackupMaxAgeHours fires PostgresBackupStale when the last successful backup is older. The
+	// operator only backs up before major upgrades, so the alert is left out unless this is set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	BackupMaxAgeHours int32 `json:"backupMaxAgeHours,omitempty"`
+	// ConnectionsPercent fires PostgresTooManyConnections above this share of max_connections. Defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	ConnectionsPercent int32 `json:"connectionsPercent,omitempty"`
+	// TransactionIDAge fires PostgresXIDWraparound when the oldest unfrozen transaction ID of a
+	// database is older. Defaults to 1500000000, wraparound happens at about 2100000000.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TransactionIDAge int64 `json:"transactionIDAge,omitempty"`
+}
+
+// PostgresPhase is a coarse summary of the instance lifecycle
+type PostgresPhase string
+
+const (
+	// PostgresPhaseCreating is set until the instance becomes ready for the first time
+	PostgresPhaseCreating PostgresPhase = "Creating"
+	PostgresPhaseReady    PostgresPhase = "Ready"
+	// PostgresPhaseNotReady is set when a previously ready instance stopped serving
+	PostgresPhaseNotReady PostgresPhase = "NotReady"
+	PostgresPhaseDeleting PostgresPhase = "Deleting"
+	// PostgresPhaseUpgrading is set while a major version upgrade runs
+	PostgresPhaseUpgrading PostgresPhase = "Upgrading"
+)
+
+// UpgradeStep is the step a major version upgrade is in
+type UpgradeStep string
+
+const (
+	// UpgradeStepProvisioning starts the instance of the new version of a blue/green upgrade
+	UpgradeStepProvisioning UpgradeStep = "Provisioning"
+	// UpgradeStepCopyingSchema copies the roles and the schema of every database in a Job
+	UpgradeStepCopyingSchema UpgradeStep = "CopyingSchema"
+	// UpgradeStepReplicating subscribes the new instance to all tables of the old one and waits
+	// for the initial copy
+	UpgradeStepReplicating UpgradeStep = "Replicating"
+	// UpgradeStepWaitingForCutover keeps replicating until the cutover action is requested
+	UpgradeStepWaitingForCutover UpgradeStep = "WaitingForCutover"
+	// UpgradeStepCuttingOver makes the old instance read-only, waits for zero lag, copies the
+	// sequences and switches the Service over
+	UpgradeStepCuttingOver UpgradeStep = "CuttingOver"
+	// UpgradeStepSwitched serves from the new instance and keeps the old one until the confirm action
+	UpgradeStepSwitched UpgradeStep = "Switched"
+	// UpgradeStepPromoting replaces the data volume of the instance by the one of the new instance
+	UpgradeStepPromoting UpgradeStep = "Promoting"
+	// UpgradeStepSnapshotting takes a VolumeSnapshot of every data volume to roll back to
+	UpgradeStepSnapshotting UpgradeStep = "Snapshotting"
+	// UpgradeStepStopping scales the instance down
+	UpgradeStepStopping UpgradeStep = "Stopping"
+	// UpgradeStepUpgrading runs pg_upgrade --link in a Job
+	UpgradeStepUpgrading UpgradeStep = "Upgrading"
+	// UpgradeStepStarting starts the instance on the new version
+	UpgradeStepStarting UpgradeStep = "Starting"
+	// UpgradeStepAnalyzing collects planner statistics, which pg_upgrade does not carry over
+	UpgradeStepAnalyzing UpgradeStep = "Analyzing"
+	UpgradeStepCompleted UpgradeStep = "Completed"
+	// UpgradeStepRollingBack restores the data volumes from the snapshots
+	UpgradeStepRollingBack UpgradeStep = "RollingBack"
+	// UpgradeStepRolledBack means the instance runs the old version again, the upgrade is retried
+	// once spec.postgresql.version changes
+	UpgradeStepRolledBack UpgradeStep = "RolledBack"
+)
+
+// UpgradeStatus reports the progress of the latest major version upgrade
+type UpgradeStatus struct {
+	// +optional
+	Strategy    UpgradeStrategy `json:"strategy,omitempty"`
+	FromVersion string          `json:"fromVersion"`
+	ToVersion   string          `json:"toVersion"`
+	Step        UpgradeStep     `json:"step"`
+	// StartTime is when the upgrade started, it names the snapshots taken before the upgrade
+	StartTime metav1.Time `json:"startTime"`
+	// StepTime is when the upgrade entered its current step
+	// +optional
+	StepTime metav1.Time `json:"stepTime,omitempty"`
+	// Message explains why the upgrade was rolled back
+	// +optional
+	Message string `json:"message,omitempty"`
+	// VolumeName is the PersistentVolume of the new instance a blue/green upgrade moves over
+	// +optional
+	VolumeName string `json:"volumeName,omitempty"`
+	// ConnectionLimits are the connection limits of the databases of the instance before the
+	// cutover of a blue/green upgrade blocked new connections to it
+	// +optional
+	ConnectionLimits map[string]int32 `json:"connectionLimits,omitempty"`
+}
+
+// InProgress reports whether the upgrade still has steps to run
+func (u *UpgradeStatus) InProgress() bool {
+	return u != nil && u.Step != UpgradeStepCompleted && u.Step != UpgradeStepRolledBack
+}
+
+type PostgresStatus struct {
+	Ready bool `json:"ready"`
+	// +optional
+	Phase PostgresPhase `json:"phase,omitempty"`
+	// Version is the version every pod of the instance runs, it follows spec version once a
+	// rolling update completed
+	// +optional
+	Version string `json:"version,omitempty"`
+	// Image is the postgres image every pod of the instance runs
+	// +optional
+	Image string `json:"image,omitempty"`
+	// CurrentPrimary is the pod serving the instance
+	// +optional
+	CurrentPrimary string `json:"currentPrimary,omitempty"`
+	// CurrentPrimaryUID is the UID of that pod, a change means the primary was replaced
+	// +optional
+	CurrentPrimaryUID string `json:"currentPrimaryUID,omitempty"`
+	// Upgrade reports the progress of the latest major version upgrade
+	// +optional
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+	// LastSuccessfulBackup is the time the latest VolumeSnapshots of the data volumes were ready.
+	// They are taken before every major version upgrade.
+	// +optional
+	LastSuccessfulBackup *metav1.Time `json:"lastSuccessfulBackup,omitempty"`
+	// Conditions describe the state of the instance in the standard form, see ConditionReady
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// ConditionReady is true while every pod of the instance is ready
+	ConditionReady = "Ready"
+	// ConditionStorageSize is false while a data volume does not have the size of spec.storage.size
+	ConditionStorageSize = "StorageSize"
+	// ConditionExtensions is false while shared_preload_libraries lists a library the ImageCatalog
+	// image does not provide
+	ConditionExtensions = "Extensions"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.postgresql.version`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type Postgres struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PostgresSpec   `json:"spec,omitempty"`
+	Status PostgresStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type PostgresList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Postgres `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Postgres{}, &PostgresList{})
+}
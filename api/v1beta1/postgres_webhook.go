@@ -0,0 +1,346 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var postgreslog = logf.Log.WithName("postgres-resource")
+
+// SetupWebhookWithManager will setup the manager to manage the webhooks
+func (r *Postgres) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-postgres-snappcloud-io-v1beta1-postgres,mutating=true,failurePolicy=fail,sideEffects=None,groups=postgres.snappcloud.io,resources=postgres,verbs=create;update,versions=v1beta1,name=mpostgres.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &Postgres{}
+
+const (
+	// DefaultVersion is the postgres image tag used when spec.postgresql.version is not set
+	DefaultVersion = "18"
+	// DefaultStorageSize is the data volume size used when spec.storage.size is not set
+	DefaultStorageSize = "1Gi"
+)
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *Postgres) Default() {
+	postgreslog.Info("default", "name", r.Name)
+
+	r.SetDefaults()
+}
+
+// SetDefaults fills in every unset field the operator has a default for, so the stored object
+// shows what runs. The controller applies it too, in case the webhook is not deployed.
+func (r *Postgres) SetDefaults() {
+	if r.Spec.PostgreSQL.Version == "" {
+		r.Spec.PostgreSQL.Version = DefaultVersion
+	}
+	if r.Spec.Storage.Size == "" {
+		r.Spec.Storage.Size = DefaultStorageSize
+	}
+	if r.Spec.Auth.Database == "" {
+		r.Spec.Auth.Database = r.Name
+	}
+	if r.Spec.Auth.SecretRef == "" {
+		r.Spec.Auth.SecretRef = r.GeneratedSecretName()
+	}
+	if r.Spec.Deletion.Policy == "" {
+		r.Spec.Deletion.Policy = DeletionPolicyRetain
+	}
+	if r.Spec.Resources == nil {
+		r.Spec.Resources = &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("250m"),
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+		}
+	}
+
+	if r.Spec.Probes == nil {
+		r.Spec.Probes = &Probes{}
+	}
+	// The startup probe allows five minutes for crash recovery before liveness takes over
+	r.Spec.Probes.Startup = defaultProbeTiming(r.Spec.Probes.Startup, ProbeTiming{PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 30})
+	r.Spec.Probes.Liveness = defaultProbeTiming(r.Spec.Probes.Liveness, ProbeTiming{PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 6})
+	r.Spec.Probes.Readiness = defaultProbeTiming(r.Spec.Probes.Readiness, ProbeTiming{PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 3})
+}
+
+// GeneratedSecretName is the default credentials Secret, which the operator creates when missing
+func (r *Postgres) GeneratedSecretName() string {
+	return r.Name + "-credentials"
+}
+
+func defaultProbeTiming(timing *ProbeTiming, defaults ProbeTiming) *ProbeTiming {
+	if timing == nil {
+		return &defaults
+	}
+	if timing.PeriodSeconds == 0 {
+		timing.PeriodSeconds = defaults.PeriodSeconds
+	}
+	if timing.TimeoutSeconds == 0 {
+		timing.TimeoutSeconds = defaults.TimeoutSeconds
+	}
+	if timing.FailureThreshold == 0 {
+		timing.FailureThreshold = defaults.FailureThreshold
+	}
+	return timing
+}
+
+//+kubebuilder:webhook:path=/validate-postgres-snappcloud-io-v1beta1-postgres,mutating=false,failurePolicy=fail,sideEffects=None,groups=postgres.snappcloud.io,resources=postgres,verbs=create;update;delete,versions=v1beta1,name=vpostgres.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &Postgres{}
+
+var (
+	// versionPattern matches the postgres image tags the operator supports, e.g. 16, 16.2 or 16.2-bookworm
+	versionPattern = regexp.MustCompile(`^([0-9]+)(\.[0-9]+)?(-[a-z0-9][a-z0-9.-]*)?$`)
+	// parameterPattern matches postgresql.conf setting names, including custom extension settings
+	parameterPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+	// rolePattern matches role names of at most 63 bytes that need no escaping in pg_hba.conf
+	rolePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+)
+
+// reservedParameters are set by the operator and cannot be overridden through spec.postgresql.parameters
+var reservedParameters = map[string]bool{
+	"config_file":    true,
+	"data_directory": true,
+	"hba_file":       true,
+	"ident_file":     true,
+	"port":           true,
+	"ssl":            true,
+	"ssl_ca_file":    true,
+	"ssl_cert_file":  true,
+	"ssl_key_file":   true,
+}
+
+// unsafeParameters trade durability for speed and only warn
+var unsafeParameters = map[string]string{
+	"fsync":              "off",
+	"full_page_writes":   "off",
+	"synchronous_commit": "off",
+}
+
+// oldestSupportedMajor is the oldest major version still maintained by the PostgreSQL project
+const oldestSupportedMajor = 14
+
+// MajorVersion returns the major version of a spec.postgresql.version value, or 0 if it is malformed
+func MajorVersion(version string) int {
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(match[1])
+	return major
+}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Postgres) ValidateCreate() (admission.Warnings, error) {
+	postgreslog.Info("validate create", "name", r.Name)
+
+	warnings, errs := r.validateSpec()
+	return warnings, r.invalid(errs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *Postgres) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	postgreslog.Info("validate update", "name", r.Name)
+
+	oldPostgres, ok := old.(*Postgres)
+	if !ok {
+		return nil, fmt.Errorf("expected a Postgres but got a %T", old)
+	}
+	// Removing the finalizer of a deleted object must not fail on a spec that later rules reject
+	if r.DeletionTimestamp != nil && equality.Semantic.DeepEqual(r.Spec, oldPostgres.Spec) {
+		return nil, nil
+	}
+	warnings, errs := r.validateSpec()
+	errs = append(errs, r.validateChanges(oldPostgres)...)
+	return warnings, r.invalid(errs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *Postgres) ValidateDelete() (admission.Warnings, error) {
+	postgreslog.Info("validate delete", "name", r.Name)
+
+	if r.Spec.Deletion.Protection {
+		return nil, fmt.Errorf("postgres %s/%s has deletion protection enabled, set spec.deletion.protection to false before deleting it",
+			r.Namespace, r.Name)
+	}
+	return nil, nil
+}
+
+// validateSpec checks the spec on its own and returns warnings for valid but risky settings
+func (r *Postgres) validateSpec() (admission.Warnings, field.ErrorList) {
+	var warnings admission.Warnings
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if !versionPattern.MatchString(r.Spec.PostgreSQL.Version) {
+		errs = append(errs, field.Invalid(spec.Child("postgresql", "version"), r.Spec.PostgreSQL.Version,
+			"must be a postgres image tag like 16, 16.2 or 16.2-bookworm"))
+	} else if major := MajorVersion(r.Spec.PostgreSQL.Version); major < oldestSupportedMajor {
+		warnings = append(warnings, fmt.Sprintf("PostgreSQL %d is end of life and no longer receives security fixes", major))
+	}
+
+	if r.Spec.Image != "" && r.Spec.ImageCatalogRef != nil {
+		warnings = append(warnings, "spec.image takes precedence over spec.imageCatalogRef for version "+r.Spec.PostgreSQL.Version)
+	}
+
+	if size, err := resource.ParseQuantity(r.Spec.Storage.Size); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("storage", "size"), r.Spec.Storage.Size, err.Error()))
+	} else if size.Sign() <= 0 {
+		errs = append(errs, field.Invalid(spec.Child("storage", "size"), r.Spec.Storage.Size, "must be greater than zero"))
+	}
+
+	if r.Spec.Auth.SecretRef == "" {
+		errs = append(errs, field.Required(spec.Child("auth", "secretRef"), "the credentials Secret must be named"))
+	}
+	if r.Spec.Auth.Database == "" {
+		errs = append(errs, field.Required(spec.Child("auth", "database"), ""))
+	}
+
+	if tls := r.Spec.TLS; tls != nil {
+		tlsPath := spec.Child("tls")
+		switch tls.Mode {
+		case TLSModeSecretRef:
+			if tls.SecretRef == "" {
+				errs = append(errs, field.Required(tlsPath.Child("secretRef"), "required with mode secretRef"))
+			}
+			if len(tls.ClientCertificates) > 0 {
+				errs = append(errs, field.Forbidden(tlsPath.Child("clientCertificates"), "only supported with mode operator"))
+			}
+		case TLSModeOperator:
+			if tls.SecretRef != "" {
+				warnings = append(warnings, "spec.tls.secretRef is ignored with mode operator")
+			}
+		}
+		roles := map[string]bool{}
+		for i, cc := range tls.ClientCertificates {
+			rolePath := tlsPath.Child("clientCertificates").Index(i).Child("role")
+			if cc.Role == "" {
+				errs = append(errs, field.Required(rolePath, ""))
+			} else if !rolePattern.MatchString(cc.Role) {
+				errs = append(errs, field.Invalid(rolePath, cc.Role,
+					"must start with a letter or underscore, contain only letters, digits and underscores and be at most 63 characters"))
+			} else if roles[cc.Role] {
+				errs = append(errs, field.Duplicate(rolePath, cc.Role))
+			}
+			roles[cc.Role] = true
+		}
+	}
+
+	for name, value := range r.Spec.PostgreSQL.Parameters {
+		namePath := spec.Child("postgresql", "parameters").Key(name)
+		switch {
+		case !parameterPattern.MatchString(name):
+			errs = append(errs, field.Invalid(namePath, name, "must be a lowercase postgresql.conf setting name"))
+		case reservedParameters[name]:
+			errs = append(errs, field.Forbidden(namePath, "managed by the operator"))
+		case name == "wal_level" && value != "logical" && r.Spec.PostgreSQL.UpgradeStrategy == UpgradeStrategyBlueGreen:
+			errs = append(errs, field.Invalid(namePath, value, "must be logical with upgrade strategy BlueGreen"))
+		case unsafeParameters[name] == value:
+			warnings = append(warnings, fmt.Sprintf("%s=%s can lose committed transactions or corrupt data on a crash", name, value))
+		}
+	}
+
+	if r.Spec.Monitoring != nil {
+		for i, ref := range r.Spec.Monitoring.CustomQueries {
+			refPath := spec.Child("monitoring", "customQueries").Index(i)
+			if ref.Name == "" {
+				errs = append(errs, field.Required(refPath.Child("name"), ""))
+			}
+			if ref.Key == "" {
+				errs = append(errs, field.Required(refPath.Child("key"), ""))
+			}
+		}
+	}
+
+	if r.Spec.Deletion.Policy == DeletionPolicyDelete && !r.Spec.Deletion.Protection {
+		warnings = append(warnings, "deletion policy Delete removes the data volumes together with the Postgres object, "+
+			"consider enabling deletion protection")
+	}
+	if r.Spec.Security.RunAsRoot {
+		warnings = append(warnings, "spec.security.runAsRoot runs the pods as root, they do not pass the restricted Pod Security Standard")
+	}
+	if r.Spec.Disruption.BlockPrimaryEviction {
+		warnings = append(warnings, "spec.disruption.blockPrimaryEviction blocks node drains on the node of the primary until it is turned off")
+	}
+	return warnings, errs
+}
+
+// validateChanges checks that an update only changes what the operator can apply
+func (r *Postgres) validateChanges(old *Postgres) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if r.Spec.Auth.Database != old.Spec.Auth.Database {
+		errs = append(errs, field.Forbidden(spec.Child("auth", "database"), "field is immutable, the database is created on first start"))
+	}
+
+	if oldMajor, major := MajorVersion(old.Spec.PostgreSQL.Version), MajorVersion(r.Spec.PostgreSQL.Version); oldMajor != 0 && major != 0 && major < oldMajor {
+		errs = append(errs, field.Forbidden(spec.Child("postgresql", "version"),
+			fmt.Sprintf("downgrading the major version from %d to %d is not supported", oldMajor, major)))
+	}
+	if r.Spec.Image != "" && r.Spec.Image == old.Spec.Image &&
+		MajorVersion(r.Spec.PostgreSQL.Version) != MajorVersion(old.Spec.PostgreSQL.Version) {
+		errs = append(errs, field.Forbidden(spec.Child("image"), "must be changed together with the major version"))
+	}
+	if old.Status.Upgrade.InProgress() && r.Spec.PostgreSQL.Version != old.Spec.PostgreSQL.Version {
+		errs = append(errs, field.Forbidden(spec.Child("postgresql", "version"),
+			fmt.Sprintf("an upgrade to %s is in progress", old.Status.Upgrade.ToVersion)))
+	}
+	if old.Status.Upgrade.InProgress() && r.Spec.PostgreSQL.UpgradeStrategy != old.Spec.PostgreSQL.UpgradeStrategy {
+		errs = append(errs, field.Forbidden(spec.Child("postgresql", "upgradeStrategy"),
+			fmt.Sprintf("an upgrade to %s is in progress", old.Status.Upgrade.ToVersion)))
+	}
+
+	oldSize, oldErr := resource.ParseQuantity(old.Spec.Storage.Size)
+	size, err := resource.ParseQuantity(r.Spec.Storage.Size)
+	if oldErr == nil && err == nil && size.Cmp(oldSize) < 0 {
+		errs = append(errs, field.Forbidden(spec.Child("storage", "size"),
+			fmt.Sprintf("volumes cannot shrink from %s to %s", oldSize.String(), size.String())))
+	}
+	return errs
+}
+
+// invalid turns a list of field errors into the error returned by the webhook
+func (r *Postgres) invalid(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Postgres").GroupKind(), r.Name, errs)
+}
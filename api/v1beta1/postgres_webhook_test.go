@@ -0,0 +1,218 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Postgres Webhook", func() {
+	valid := func() *Postgres {
+		pg := &Postgres{
+			Spec: PostgresSpec{
+				PostgreSQL: PostgreSQLSpec{Version: "16.2"},
+				Storage:    StorageSpec{Size: "10Gi"},
+				Auth:       Auth{Database: "app", SecretRef: "credentials"},
+			},
+		}
+		pg.Name = "orders"
+		return pg
+	}
+
+	Context("When creating Postgres under Defaulting Webhook", func() {
+		It("Should fill in the defaults", func() {
+			pg := &Postgres{}
+			pg.Name = "orders"
+			pg.Default()
+
+			Expect(pg.Spec.PostgreSQL.Version).To(Equal(DefaultVersion))
+			Expect(pg.Spec.Storage.Size).To(Equal(DefaultStorageSize))
+			Expect(pg.Spec.Auth.Database).To(Equal("orders"))
+			Expect(pg.Spec.Auth.SecretRef).To(Equal("orders-credentials"))
+			Expect(pg.Spec.Resources).NotTo(BeNil())
+			Expect(pg.Spec.Probes.Startup.FailureThreshold).To(Equal(int32(30)))
+
+			_, err := pg.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should keep values that are set", func() {
+			pg := valid()
+			pg.Spec.Probes = &Probes{Liveness: &ProbeTiming{PeriodSeconds: 30}}
+			pg.Default()
+
+			Expect(pg.Spec.PostgreSQL.Version).To(Equal("16.2"))
+			Expect(pg.Spec.Auth.Database).To(Equal("app"))
+			Expect(pg.Spec.Probes.Liveness.PeriodSeconds).To(Equal(int32(30)))
+			Expect(pg.Spec.Probes.Liveness.TimeoutSeconds).To(Equal(int32(5)))
+		})
+	})
+
+	Context("When creating Postgres under Validating Webhook", func() {
+		It("Should admit a valid spec", func() {
+			warnings, err := valid().ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("Should deny invalid fields", func() {
+			pg := valid()
+			pg.Spec.PostgreSQL.Version = "latest"
+			pg.Spec.Storage.Size = "ten gigs"
+			pg.Spec.Auth.SecretRef = ""
+			pg.Spec.PostgreSQL.Parameters = map[string]string{"Shared Buffers": "1GB", "hba_file": "/tmp/hba"}
+			_, err := pg.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+			for _, field := range []string{"spec.postgresql.version", "spec.storage.size", "spec.auth.secretRef",
+				"spec.postgresql.parameters[Shared Buffers]", "spec.postgresql.parameters[hba_file]"} {
+				Expect(err.Error()).To(ContainSubstring(field))
+			}
+		})
+
+		It("Should deny client certificate roles that cannot be written to pg_hba.conf", func() {
+			pg := valid()
+			pg.Spec.TLS = &TLS{Mode: TLSModeOperator, ClientCertificates: []ClientCertificate{
+				{Role: "Reporting_Jobs"}, {Role: `bi"lling`}, {Role: `ops\`}, {Role: "1app"}, {Role: strings.Repeat("r", 64)},
+			}}
+			_, err := pg.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+			for i := 1; i <= 4; i++ {
+				Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("spec.tls.clientCertificates[%d].role", i)))
+			}
+			Expect(err.Error()).NotTo(ContainSubstring("spec.tls.clientCertificates[0].role"))
+
+			pg.Spec.TLS.ClientCertificates = []ClientCertificate{{Role: "Reporting_Jobs"}, {Role: strings.Repeat("r", 63)}}
+			_, err = pg.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should require logical decoding for blue/green upgrades", func() {
+			pg := valid()
+			pg.Spec.PostgreSQL.UpgradeStrategy = UpgradeStrategyBlueGreen
+			pg.Spec.PostgreSQL.Parameters = map[string]string{"wal_level": "replica"}
+			_, err := pg.ValidateCreate()
+			Expect(err).To(MatchError(ContainSubstring("spec.postgresql.parameters[wal_level]")))
+		})
+
+		It("Should warn about risky settings", func() {
+			pg := valid()
+			pg.Spec.PostgreSQL.Version = "12"
+			pg.Spec.PostgreSQL.Parameters = map[string]string{"fsync": "off"}
+			pg.Spec.Disruption.BlockPrimaryEviction = true
+			pg.Spec.Security.RunAsRoot = true
+			warnings, err := pg.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(4))
+		})
+	})
+
+	Context("When updating Postgres under Validating Webhook", func() {
+		It("Should deny immutable changes and shrinking", func() {
+			pg := valid()
+			pg.Spec.Auth.Database = "other"
+			pg.Spec.PostgreSQL.Version = "15"
+			pg.Spec.Storage.Size = "5Gi"
+			_, err := pg.ValidateUpdate(valid())
+			Expect(err).To(HaveOccurred())
+			for _, field := range []string{"spec.auth.database", "spec.postgresql.version", "spec.storage.size"} {
+				Expect(err.Error()).To(ContainSubstring(field))
+			}
+		})
+
+		It("Should admit major version upgrades", func() {
+			pg := valid()
+			pg.Spec.PostgreSQL.Version = "17"
+			_, err := pg.ValidateUpdate(valid())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny version changes while an upgrade is in progress", func() {
+			old := valid()
+			old.Status.Upgrade = &UpgradeStatus{FromVersion: "15", ToVersion: "16.2", Step: UpgradeStepUpgrading}
+			pg := old.DeepCopy()
+			pg.Spec.PostgreSQL.Version = "17"
+			_, err := pg.ValidateUpdate(old)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("spec.postgresql.version"))
+		})
+
+		It("Should deny strategy changes while an upgrade is in progress", func() {
+			old := valid()
+			old.Status.Upgrade = &UpgradeStatus{FromVersion: "15", ToVersion: "16.2", Step: UpgradeStepReplicating}
+			pg := old.DeepCopy()
+			pg.Spec.PostgreSQL.UpgradeStrategy = UpgradeStrategyBlueGreen
+			_, err := pg.ValidateUpdate(old)
+			Expect(err).To(MatchError(ContainSubstring("spec.postgresql.upgradeStrategy")))
+		})
+
+		It("Should deny a major version change that keeps the image override", func() {
+			old := valid()
+			old.Spec.Image = "registry.example.com/postgres:16-hardened"
+			pg := old.DeepCopy()
+			pg.Spec.PostgreSQL.Version = "17"
+			_, err := pg.ValidateUpdate(old)
+			Expect(err).To(MatchError(ContainSubstring("spec.image")))
+
+			pg.Spec.Image = "registry.example.com/postgres:17-hardened"
+			_, err = pg.ValidateUpdate(old)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should admit minor version updates and growing volumes", func() {
+			pg := valid()
+			pg.Spec.PostgreSQL.Version = "16.4"
+			pg.Spec.Storage.Size = "20Gi"
+			_, err := pg.ValidateUpdate(valid())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should admit removing the finalizer of a deleted Postgres", func() {
+			old := valid()
+			old.Spec.Storage.Size = "invalid"
+			now := metav1.Now()
+			old.DeletionTimestamp = &now
+			old.Finalizers = []string{"postgres.finalizer"}
+			pg := old.DeepCopy()
+			pg.Finalizers = nil
+			_, err := pg.ValidateUpdate(old)
+			Expect(err).NotTo(HaveOccurred())
+
+			pg.Spec.Auth.Database = "other"
+			_, err = pg.ValidateUpdate(old)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When deleting Postgres under Validating Webhook", func() {
+		It("Should deny deletion while deletion protection is set", func() {
+			pg := &Postgres{Spec: PostgresSpec{Deletion: DeletionSpec{Protection: true}}}
+			_, err := pg.ValidateDelete()
+			Expect(err).To(MatchError(ContainSubstring("deletion protection")))
+		})
+
+		It("Should admit deletion without deletion protection", func() {
+			pg := &Postgres{}
+			_, err := pg.ValidateDelete()
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
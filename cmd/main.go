@@ -19,7 +19,9 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -33,9 +35,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	postgresv1alpha1 "github.com/rezacloner1372/postgresql-operator/api/v1alpha1"
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
 	"github.com/rezacloner1372/postgresql-operator/internal/controller"
+	"github.com/rezacloner1372/postgresql-operator/internal/guard"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -48,6 +53,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(postgresv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(postgresv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -57,6 +63,10 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var imagePullSecrets string
+	var upgradeImage string
+	var prometheusNamespace string
+	registryRewrites := map[string]string{}
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -66,6 +76,24 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.Func("image-registry-rewrite", "Pull the images of a registry from a mirror, as registry=prefix, "+
+		"e.g. docker.io=harbor.example.com/dockerhub. Can be repeated.", func(value string) error {
+		registry, prefix, ok := strings.Cut(value, "=")
+		if !ok || registry == "" || prefix == "" {
+			return fmt.Errorf("expected registry=prefix, got %q", value)
+		}
+		registryRewrites[registry] = prefix
+		return nil
+	})
+	flag.StringVar(&imagePullSecrets, "image-pull-secrets", "",
+		"Comma separated Secrets added as imagePullSecrets to every pod the operator creates. "+
+			"They must exist in the namespace of each instance.")
+	flag.StringVar(&upgradeImage, "upgrade-image", controller.DefaultUpgradeImage,
+		"The image running pg_upgrade in major version upgrades, with the binaries of both versions. "+
+			"{from} and {to} are replaced by the major versions.")
+	flag.StringVar(&prometheusNamespace, "prometheus-namespace", "monitoring",
+		"The namespace whose pods NetworkPolicies let scrape the exporters unless an instance lists its scrapers. "+
+			"Empty closes the exporter ports to instances without scrapers.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -123,12 +151,29 @@ func main() {
 	}
 
 	if err = (&controller.PostgresReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("postgres-controller"),
+
+		RegistryRewrites:    registryRewrites,
+		ImagePullSecrets:    splitList(imagePullSecrets),
+		OperatorNamespace:   os.Getenv("POD_NAMESPACE"),
+		UpgradeImage:        upgradeImage,
+		PrometheusNamespace: prometheusNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Postgres")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&postgresv1beta1.Postgres{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Postgres")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(guard.Path, &webhook.Admission{Handler: &guard.OwnedResourceGuard{
+			Client:  mgr.GetClient(),
+			Decoder: admission.NewDecoder(mgr.GetScheme()),
+		}})
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -146,3 +191,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList returns the non-empty items of a comma separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
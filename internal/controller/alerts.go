@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var prometheusRuleGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+
+// alertThresholds returns the spec thresholds with defaults applied
+func alertThresholds(pg *postgresv1beta1.Postgres) postgresv1beta1.Alerts {
+	thresholds := postgresv1beta1.Alerts{
+		ReplicationLagSeconds: 300,
+		StorageUsagePercent:   80,
+		ConnectionsPercent:    80,
+		TransactionIDAge:      1500000000,
+	}
+	overrides := pg.Spec.Monitoring.Alerts
+	if overrides == nil {
+		return thresholds
+	}
+	if overrides.ReplicationLagSeconds != 0 {
+		thresholds.ReplicationLagSeconds = overrides.ReplicationLagSeconds
+	}
+	if overrides.StorageUsagePercent != 0 {
+		thresholds.StorageUsagePercent = overrides.StorageUsagePercent
+	}
+	if overrides.BackupMaxAgeHours != 0 {
+		thresholds.BackupMaxAgeHours = overrides.BackupMaxAgeHours
+	}
+	if overrides.ConnectionsPercent != 0 {
+		thresholds.ConnectionsPercent = overrides.ConnectionsPercent
+	}
+	if overrides.TransactionIDAge != 0 {
+		thresholds.TransactionIDAge = overrides.TransactionIDAge
+	}
+	return thresholds
+}
+
+// alertRules returns the default alerts of an instance in PrometheusRule format
+func alertRules(pg *postgresv1beta1.Postgres) []interface{} {
+	thresholds := alertThresholds(pg)
+	name := regexp.QuoteMeta(pg.Name)
+	// Exporter metrics carry the pod they were scraped from, kubelet volume metrics the claim
+	pods := fmt.Sprintf(`namespace="%s",pod=~"%s-[0-9]+"`, pg.Namespace, name)
+	claims := fmt.Sprintf(`namespace="%s",persistentvolumeclaim=~"data-%s-[0-9]+"`, pg.Namespace, name)
+	instance := fmt.Sprintf(`namespace="%s",name="%s"`, pg.Namespace, pg.Name)
+
+	rule := func(alert, expr, duration, severity, summary string) interface{} {
+		return map[string]interface{}{
+			"alert":  alert,
+			"expr":   expr,
+			"for":    duration,
+			"labels": map[string]interface{}{"severity": severity},
+			"annotations": map[string]interface{}{
+				"summary": fmt.Sprintf("Postgres %s/%s: %s", pg.Namespace, pg.Name, summary),
+			},
+		}
+	}
+
+	rules := []interface{}{
+		rule("PostgresDown",
+			fmt.Sprintf(`pg_up{%s} == 0 or absent(pg_up{%s})`, pods, pods),
+			"1m", "critical", "the instance is down"),
+		rule("PostgresReplicationLag",
+			fmt.Sprintf(`pg_replication_lag_seconds{%s} > %d`, pods, thresholds.ReplicationLagSeconds),
+			"5m", "warning", fmt.Sprintf("replication lag is above %d seconds", thresholds.ReplicationLagSeconds)),
+		rule("PostgresStorageFull",
+			fmt.Sprintf(`kubelet_volume_stats_used_bytes{%s} / kubelet_volume_stats_capacity_bytes{%s} * 100 > %d`,
+				claims, claims, thresholds.StorageUsagePercent),
+			"5m", "warning", fmt.Sprintf("storage usage is above %d%%", thresholds.StorageUsagePercent)),
+		rule("PostgresTooManyConnections",
+			fmt.Sprintf(`sum by (pod) (pg_stat_activity_count{%s}) / max by (pod) (pg_settings_max_connections{%s}) * 100 > %d`,
+				pods, pods, thresholds.ConnectionsPercent),
+			"5m", "warning", fmt.Sprintf("more than %d%% of max_connections are in use", thresholds.ConnectionsPercent)),
+		rule("PostgresXIDWraparound",
+			fmt.Sprintf(`max by (pod, datname) (pg_database_wraparound_age_datfrozenxid{%s}) > %d`, pods, thresholds.TransactionIDAge),
+			"10m", "critical", "a database is approaching transaction ID wraparound, run VACUUM FREEZE"),
+	}
+	if thresholds.BackupMaxAgeHours != 0 {
+		rules = append(rules, rule("PostgresBackupStale",
+			fmt.Sprintf(`time() - postgres_operator_last_successful_backup_timestamp_seconds{%s} > %d`,
+				instance, thresholds.BackupMaxAgeHours*3600),
+			"10m", "warning", fmt.Sprintf("the last successful backup is older than %d hours", thresholds.BackupMaxAgeHours)))
+	}
+	return rules
+}
+
+// reconcilePrometheusRule creates a PrometheusRule with the default alerts of the instance when
+// the Prometheus Operator CRDs are installed, and removes it again when monitoring is disabled.
+func (r *PostgresReconciler) reconcilePrometheusRule(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	if _, err := r.RESTMapper().RESTMapping(prometheusRuleGVK.GroupKind(), prometheusRuleGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil
+		}
+		return err
+	}
+
+	prometheusRule := &unstructured.Unstructured{}
+	prometheusRule.SetGroupVersionKind(prometheusRuleGVK)
+	prometheusRule.SetName(pg.Name)
+	prometheusRule.SetNamespace(pg.Namespace)
+	if !monitoringEnabled(pg) {
+		return r.deleteOwned(ctx, pg, prometheusRule)
+	}
+
+	return r.reconcileOwned(ctx, pg, prometheusRule, func() error {
+		prometheusRule.SetLabels(map[string]string{"app": pg.Name})
+		return unstructured.SetNestedField(prometheusRule.Object, map[string]interface{}{
+			"groups": []interface{}{
+				map[string]interface{}{
+					"name":  "postgres-" + pg.Name,
+					"rules": alertRules(pg),
+				},
+			},
+		}, "spec")
+	})
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Default alerts", func() {
+	It("should apply threshold overrides from the spec", func() {
+		pg := &postgresv1beta1.Postgres{}
+		pg.Name = "orders"
+		pg.Namespace = "shop"
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{
+			Enabled: true,
+			Alerts:  &postgresv1beta1.Alerts{StorageUsagePercent: 90},
+		}
+
+		thresholds := alertThresholds(pg)
+		Expect(thresholds.StorageUsagePercent).To(Equal(int32(90)))
+		Expect(thresholds.ConnectionsPercent).To(Equal(int32(80)))
+
+		var storage map[string]interface{}
+		for _, rule := range alertRules(pg) {
+			if r := rule.(map[string]interface{}); r["alert"] == "PostgresStorageFull" {
+				storage = r
+			}
+		}
+		Expect(storage).NotTo(BeNil())
+		Expect(storage["expr"]).To(ContainSubstring(`persistentvolumeclaim=~"data-orders-[0-9]+"`))
+		Expect(storage["expr"]).To(HaveSuffix("> 90"))
+	})
+
+	It("should only alert on stale backups when a maximum age is set", func() {
+		pg := &postgresv1beta1.Postgres{}
+		pg.Name = "orders"
+		pg.Namespace = "shop"
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{Enabled: true}
+		alerts := func() map[string]string {
+			exprs := map[string]string{}
+			for _, rule := range alertRules(pg) {
+				r := rule.(map[string]interface{})
+				exprs[r["alert"].(string)] = r["expr"].(string)
+			}
+			return exprs
+		}
+		Expect(alerts()).To(HaveKey("PostgresReplicationLag"))
+		Expect(alerts()).NotTo(HaveKey("PostgresBackupStale"))
+
+		pg.Spec.Monitoring.Alerts = &postgresv1beta1.Alerts{BackupMaxAgeHours: 24}
+		Expect(alerts()).To(HaveKeyWithValue("PostgresBackupStale",
+			`time() - postgres_operator_last_successful_backup_timestamp_seconds{namespace="shop",name="orders"} > 86400`))
+	})
+})
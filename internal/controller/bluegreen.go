@@ -0,0 +1,832 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// blueGreenName names the publications, subscriptions and replication slots of a blue/green upgrade
+	blueGreenName = "blue_green"
+
+	// reclaimPolicyAnnotation keeps the reclaim policy of the volume a blue/green upgrade moves over
+	reclaimPolicyAnnotation = "postgres.snappcloud.io/reclaim-policy"
+)
+
+func upgradeStrategy(pg *postgresv1beta1.Postgres) postgresv1beta1.UpgradeStrategy {
+	if pg.Spec.PostgreSQL.UpgradeStrategy == "" {
+		return postgresv1beta1.UpgradeStrategyInPlace
+	}
+	return pg.Spec.PostgreSQL.UpgradeStrategy
+}
+
+// greenName returns the name of the StatefulSet running the new version during a blue/green upgrade
+func greenName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-green"
+}
+
+func schemaJobName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-schema"
+}
+
+// blueGreenStep returns the step of the blue/green upgrade in progress, or "" if there is none
+func blueGreenStep(pg *postgresv1beta1.Postgres) postgresv1beta1.UpgradeStep {
+	if upgrade := pg.Status.Upgrade; upgrade.InProgress() && upgrade.Strategy == postgresv1beta1.UpgradeStrategyBlueGreen {
+		return upgrade.Step
+	}
+	return ""
+}
+
+// servingName returns the app label of the pods the Service sends clients to
+func servingName(pg *postgresv1beta1.Postgres) string {
+	switch blueGreenStep(pg) {
+	case postgresv1beta1.UpgradeStepSwitched, postgresv1beta1.UpgradeStepPromoting:
+		return greenName(pg)
+	}
+	return pg.Name
+}
+
+// blueGreenReadOnly reports whether the instance may have been made read-only for the cutover
+func blueGreenReadOnly(pg *postgresv1beta1.Postgres) bool {
+	switch blueGreenStep(pg) {
+	case postgresv1beta1.UpgradeStepCuttingOver, postgresv1beta1.UpgradeStepRollingBack:
+		return true
+	}
+	return false
+}
+
+// slotName returns the replication slot of the subscription of dbname. Slots are shared by all
+// databases of the instance, so every database needs its own.
+func slotName(dbname string) string {
+	return fmt.Sprintf("%s_%x", blueGreenName, sha256.Sum256([]byte(dbname)))[:len(blueGreenName)+9]
+}
+
+// reconcileBlueGreen runs one step of a blue/green major version upgrade and returns the delay
+// after which it wants to be called again, or zero when none is in progress. Unlike an in-place
+// upgrade the instance keeps serving until the cutover, so it runs after the rest of the
+// reconciliation. Promoting takes the instance down and runs from reconcileUpgrade instead.
+//
+// The steps are: start a StatefulSet of the new version next to the instance, copy the roles and
+// the schema of every database in a Job, subscribe the new instance to all tables and wait for the
+// initial copy. The cutover is requested with the upgrade-action annotation: it makes the instance
+// read-only, waits for the new one to catch up, copies the sequences and switches the Service
+// over. The old instance is kept until the upgrade is confirmed or aborted.
+func (r *PostgresReconciler) reconcileBlueGreen(ctx context.Context, pg *postgresv1beta1.Postgres, desired *appsv1.StatefulSet,
+	secret *corev1.Secret) (time.Duration, error) {
+	step := blueGreenStep(pg)
+	if step == "" || step == postgresv1beta1.UpgradeStepPromoting {
+		return 0, nil
+	}
+	upgrade := pg.Status.Upgrade
+	logger := log.FromContext(ctx)
+
+	if step != postgresv1beta1.UpgradeStepRollingBack && pg.Annotations[postgresv1beta1.UpgradeActionAnnotation] == postgresv1beta1.UpgradeActionAbort {
+		if err := r.takeUpgradeAction(ctx, pg); err != nil {
+			return 0, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRollingBack, "aborted")
+	}
+
+	switch step {
+	case postgresv1beta1.UpgradeStepProvisioning:
+		var green appsv1.StatefulSet
+		err := r.Get(ctx, types.NamespacedName{Name: greenName(pg), Namespace: pg.Namespace}, &green)
+		if apierrors.IsNotFound(err) {
+			image, err := r.resolveImage(ctx, pg, upgrade.ToVersion)
+			if err != nil {
+				return 0, err
+			}
+			sts := greenStatefulSet(pg, desired, image)
+			r.applyImageSettings(pg, &sts.Spec.Template.Spec)
+			if err := ctrl.SetControllerReference(pg, sts, r.Scheme); err != nil {
+				return 0, err
+			}
+			logger.Info("Creating a new StatefulSet", "StatefulSet.Namespace", sts.Namespace, "StatefulSet.Name", sts.Name)
+			if err := r.Create(ctx, sts); err != nil {
+				return 0, err
+			}
+			r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventCreated, "Created StatefulSet %s", sts.Name)
+			return upgradePollInterval, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if green.Status.ReadyReplicas != *green.Spec.Replicas {
+			return upgradePollInterval, nil
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepCopyingSchema, "")
+
+	case postgresv1beta1.UpgradeStepCopyingSchema:
+		var job batchv1.Job
+		err := r.Get(ctx, types.NamespacedName{Name: schemaJobName(pg), Namespace: pg.Namespace}, &job)
+		if apierrors.IsNotFound(err) {
+			green, err := r.greenHost(ctx, pg)
+			if err != nil {
+				return 0, err
+			}
+			image, err := r.resolveImage(ctx, pg, upgrade.ToVersion)
+			if err != nil {
+				return 0, err
+			}
+			job := jobForSchemaCopy(pg, green, image)
+			applyPodSecurity(pg, &job.Spec.Template.Spec)
+			r.applyImageSettings(pg, &job.Spec.Template.Spec)
+			if err := ctrl.SetControllerReference(pg, job, r.Scheme); err != nil {
+				return 0, err
+			}
+			logger.Info("Creating schema copy Job", "Job.Name", job.Name)
+			if err := r.Create(ctx, job); err != nil {
+				return 0, err
+			}
+			return upgradePollInterval, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if job.Status.Succeeded > 0 {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepReplicating, "")
+		}
+		if job.Status.Failed > 0 {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRollingBack, fmt.Sprintf("copying the schema failed, see the logs of Job %s", job.Name))
+		}
+		return upgradePollInterval, nil
+
+	case postgresv1beta1.UpgradeStepReplicating:
+		synced, err := r.replicate(ctx, pg, secret)
+		if err != nil {
+			return 0, err
+		}
+		if !synced {
+			return upgradePollInterval, nil
+		}
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventUpgrading, "Version %s caught up, annotate with %s=%s to switch over",
+			upgrade.ToVersion, postgresv1beta1.UpgradeActionAnnotation, postgresv1beta1.UpgradeActionCutover)
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepWaitingForCutover, "")
+
+	case postgresv1beta1.UpgradeStepWaitingForCutover:
+		if pg.Annotations[postgresv1beta1.UpgradeActionAnnotation] != postgresv1beta1.UpgradeActionCutover {
+			return upgradePollInterval, nil
+		}
+		if err := r.takeUpgradeAction(ctx, pg); err != nil {
+			return 0, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepCuttingOver, "")
+
+	case postgresv1beta1.UpgradeStepCuttingOver:
+		done, err := r.cutover(ctx, pg, secret)
+		if err != nil {
+			return 0, err
+		}
+		if !done {
+			return time.Second, nil
+		}
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventCutover, "Switched over to version %s, annotate with %s=%s to remove version %s or %s to switch back",
+			upgrade.ToVersion, postgresv1beta1.UpgradeActionAnnotation, postgresv1beta1.UpgradeActionConfirm, upgrade.FromVersion, postgresv1beta1.UpgradeActionAbort)
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepSwitched, "")
+
+	case postgresv1beta1.UpgradeStepSwitched:
+		if pg.Annotations[postgresv1beta1.UpgradeActionAnnotation] != postgresv1beta1.UpgradeActionConfirm {
+			return upgradePollInterval, nil
+		}
+		if err := r.takeUpgradeAction(ctx, pg); err != nil {
+			return 0, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepPromoting, "")
+
+	case postgresv1beta1.UpgradeStepRollingBack:
+		if err := r.resetBlue(ctx, pg, secret); err != nil {
+			return 0, err
+		}
+		if err := r.removeGreen(ctx, pg); err != nil {
+			return 0, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRolledBack, upgrade.Message)
+	}
+	return 0, nil
+}
+
+// takeUpgradeAction removes the upgrade-action annotation once its action is taken
+func (r *PostgresReconciler) takeUpgradeAction(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	status := pg.Status.DeepCopy()
+	delete(pg.Annotations, postgresv1beta1.UpgradeActionAnnotation)
+	if err := r.Update(ctx, pg); err != nil {
+		return err
+	}
+	pg.Status = *status
+	return nil
+}
+
+// promoteGreen runs the Promoting step of a blue/green upgrade: it moves the data volume of the
+// new instance over to the instance and starts it with the new version. The volume is retained
+// while no claim is bound to it.
+func (r *PostgresReconciler) promoteGreen(ctx context.Context, pg *postgresv1beta1.Postgres, sts, desired *appsv1.StatefulSet) (time.Duration, error) {
+	upgrade := pg.Status.Upgrade
+	logger := log.FromContext(ctx)
+	blueClaim := dataClaimName(pg, 0)
+	greenClaim := "data-" + greenName(pg) + "-0"
+
+	if upgrade.VolumeName == "" {
+		var pvc corev1.PersistentVolumeClaim
+		if err := r.Get(ctx, types.NamespacedName{Name: greenClaim, Namespace: pg.Namespace}, &pvc); err != nil {
+			return 0, err
+		}
+		if pvc.Spec.VolumeName == "" {
+			return 0, fmt.Errorf("volume claim %s is not bound", greenClaim)
+		}
+		var pv corev1.PersistentVolume
+		if err := r.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, &pv); err != nil {
+			return 0, err
+		}
+		if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+			if pv.Annotations == nil {
+				pv.Annotations = map[string]string{}
+			}
+			pv.Annotations[reclaimPolicyAnnotation] = string(pv.Spec.PersistentVolumeReclaimPolicy)
+			pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+			if err := r.Update(ctx, &pv); err != nil {
+				return 0, err
+			}
+		}
+		upgrade.VolumeName = pv.Name
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepPromoting, "")
+	}
+
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, types.NamespacedName{Name: blueClaim, Namespace: pg.Namespace}, &pvc)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+	if err != nil || pvc.Spec.VolumeName != upgrade.VolumeName {
+		stopped, err := r.stopBlueGreen(ctx, pg, sts)
+		if err != nil || !stopped {
+			return upgradePollInterval, err
+		}
+		for _, name := range []string{blueClaim, greenClaim} {
+			claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace}}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(claim), claim); apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			if claim.DeletionTimestamp.IsZero() {
+				r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleting, "Deleting volume %s to replace it by volume %s", name, upgrade.VolumeName)
+				if err := r.Delete(ctx, claim); client.IgnoreNotFound(err) != nil {
+					return 0, err
+				}
+			}
+			return upgradePollInterval, nil
+		}
+
+		var pv corev1.PersistentVolume
+		if err := r.Get(ctx, types.NamespacedName{Name: upgrade.VolumeName}, &pv); err != nil {
+			return 0, err
+		}
+		if pv.Spec.ClaimRef != nil {
+			pv.Spec.ClaimRef = nil
+			if err := r.Update(ctx, &pv); err != nil {
+				return 0, err
+			}
+		}
+		pvc = corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: blueClaim, Namespace: pg.Namespace, Labels: dataClaimLabels(pg)},
+			Spec:       *sts.Spec.VolumeClaimTemplates[0].Spec.DeepCopy(),
+		}
+		pvc.Spec.VolumeName = upgrade.VolumeName
+		logger.Info("Binding volume claim", "PersistentVolumeClaim.Name", blueClaim, "PersistentVolume.Name", upgrade.VolumeName)
+		if err := r.Create(ctx, &pvc); err != nil {
+			return 0, err
+		}
+		return upgradePollInterval, nil
+	}
+
+	if *sts.Spec.Replicas == 0 {
+		startUpgraded(sts, desired)
+		if err := r.Update(ctx, sts); err != nil {
+			return 0, err
+		}
+		return upgradePollInterval, nil
+	}
+	if sts.Status.ObservedGeneration != sts.Generation || sts.Status.ReadyReplicas != *sts.Spec.Replicas {
+		return upgradePollInterval, nil
+	}
+
+	var pv corev1.PersistentVolume
+	if err := r.Get(ctx, types.NamespacedName{Name: upgrade.VolumeName}, &pv); err != nil {
+		return 0, err
+	}
+	if policy, ok := pv.Annotations[reclaimPolicyAnnotation]; ok {
+		pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimPolicy(policy)
+		delete(pv.Annotations, reclaimPolicyAnnotation)
+		if err := r.Update(ctx, &pv); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.removeGreen(ctx, pg); err != nil {
+		return 0, err
+	}
+	pg.Status.Version = upgrade.ToVersion
+	r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventUpdated, "Upgraded from version %s to %s", upgrade.FromVersion, upgrade.ToVersion)
+	return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepCompleted, "")
+}
+
+// stopBlueGreen scales both StatefulSets down and reports whether all their pods are gone
+func (r *PostgresReconciler) stopBlueGreen(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet) (bool, error) {
+	var green appsv1.StatefulSet
+	err := r.Get(ctx, types.NamespacedName{Name: greenName(pg), Namespace: pg.Namespace}, &green)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	for _, s := range []*appsv1.StatefulSet{sts, &green} {
+		if s.Spec.Replicas == nil || *s.Spec.Replicas == 0 {
+			continue
+		}
+		replicas := int32(0)
+		s.Spec.Replicas = &replicas
+		if err := r.Update(ctx, s); err != nil {
+			return false, err
+		}
+	}
+	for _, app := range []string{pg.Name, greenName(pg)} {
+		var pods corev1.PodList
+		if err := r.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels{"app": app}); err != nil {
+			return false, err
+		}
+		if len(pods.Items) > 0 {
+			log.FromContext(ctx).Info("Waiting for pods to terminate", "Pods", len(pods.Items))
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// removeGreen deletes the StatefulSet, the data volumes and the Job of a blue/green upgrade
+func (r *PostgresReconciler) removeGreen(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	for _, obj := range []client.Object{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: greenName(pg), Namespace: pg.Namespace}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: schemaJobName(pg), Namespace: pg.Namespace}},
+	} {
+		if err := r.deleteOwned(ctx, pg, obj); err != nil {
+			return err
+		}
+	}
+	var claims corev1.PersistentVolumeClaimList
+	if err := r.List(ctx, &claims, client.InNamespace(pg.Namespace), client.MatchingLabels{"app": greenName(pg)}); err != nil {
+		return err
+	}
+	for i := range claims.Items {
+		if !claims.Items[i].DeletionTimestamp.IsZero() {
+			continue
+		}
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleting, "Deleting volume %s", claims.Items[i].Name)
+		if err := r.Delete(ctx, &claims.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// greenHost returns the address of the pod running the new version
+func (r *PostgresReconciler) greenHost(ctx context.Context, pg *postgresv1beta1.Postgres) (string, error) {
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Name: greenName(pg) + "-0", Namespace: pg.Namespace}, &pod); err != nil {
+		return "", err
+	}
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("pod %s has no IP", pod.Name)
+	}
+	return pod.Status.PodIP, nil
+}
+
+// blueHost returns the address of the pod running the old version. The Service cannot be used
+// around the cutover, it may already point to the new version.
+func (r *PostgresReconciler) blueHost(ctx context.Context, pg *postgresv1beta1.Postgres) (string, error) {
+	pod, err := r.primaryPod(ctx, pg)
+	if err != nil {
+		return "", err
+	}
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("pod %s has no IP", pod.Name)
+	}
+	return pod.Status.PodIP, nil
+}
+
+// replicate publishes all tables of every database on the instance, subscribes the new instance
+// to them and reports whether the initial copy of every table finished
+func (r *PostgresReconciler) replicate(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret) (bool, error) {
+	blueHost, err := r.blueHost(ctx, pg)
+	if err != nil {
+		return false, err
+	}
+	greenHost, err := r.greenHost(ctx, pg)
+	if err != nil {
+		return false, err
+	}
+	names, err := listDatabases(ctx, pg, secret, blueHost)
+	if err != nil {
+		return false, err
+	}
+
+	synced := true
+	for _, name := range names {
+		err := withDatabase(pg, secret, blueHost, name, func(db *sql.DB) error {
+			var exists bool
+			if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", blueGreenName).Scan(&exists); err != nil || exists {
+				return err
+			}
+			_, err := db.ExecContext(ctx, "CREATE PUBLICATION "+blueGreenName+" FOR ALL TABLES")
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("publishing database %s: %w", name, err)
+		}
+
+		err = withDatabase(pg, secret, greenHost, name, func(db *sql.DB) error {
+			var exists bool
+			if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_subscription s JOIN pg_database d ON d.oid = s.subdbid
+				WHERE s.subname = $1 AND d.datname = current_database())`, blueGreenName).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				if _, err := db.ExecContext(ctx, "CREATE SUBSCRIPTION "+blueGreenName+" CONNECTION "+pq.QuoteLiteral(blueConninfo(pg, secret, name))+
+					" PUBLICATION "+blueGreenName+" WITH (slot_name = "+pq.QuoteLiteral(slotName(name))+")"); err != nil {
+					return err
+				}
+				synced = false
+				return nil
+			}
+			var pending int
+			if err := db.QueryRowContext(ctx, "SELECT count(*) FROM pg_subscription_rel WHERE srsubstate <> 'r'").Scan(&pending); err != nil {
+				return err
+			}
+			synced = synced && pending == 0
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("subscribing database %s: %w", name, err)
+		}
+	}
+	return synced, nil
+}
+
+// cutover makes the instance read-only, waits for every subscription to catch up, copies the
+// sequences and drops the subscriptions. It reports whether it is done and can be run again.
+func (r *PostgresReconciler) cutover(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret) (bool, error) {
+	blueHost, err := r.blueHost(ctx, pg)
+	if err != nil {
+		return false, err
+	}
+	greenHost, err := r.greenHost(ctx, pg)
+	if err != nil {
+		return false, err
+	}
+
+	// The limits are recorded before they are lowered, so that an abort can restore them
+	if pg.Status.Upgrade.ConnectionLimits == nil {
+		limits := map[string]int32{}
+		err := withDatabase(pg, secret, blueHost, "postgres", func(db *sql.DB) error {
+			rows, err := db.QueryContext(ctx, "SELECT datname, datconnlimit FROM pg_database WHERE datallowconn AND NOT datistemplate")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var name string
+				var limit int32
+				if err := rows.Scan(&name, &limit); err != nil {
+					return err
+				}
+				limits[name] = limit
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return false, fmt.Errorf("reading the connection limits: %w", err)
+		}
+		pg.Status.Upgrade.ConnectionLimits = limits
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return false, err
+		}
+	}
+
+	// Superusers are exempt from connection limits and can override the read-only default, so
+	// client sessions are terminated on every check until the new instance caught up
+	err = withDatabase(pg, secret, blueHost, "postgres", func(db *sql.DB) error {
+		for name := range pg.Status.Upgrade.ConnectionLimits {
+			if _, err := db.ExecContext(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" CONNECTION LIMIT 0"); err != nil {
+				return err
+			}
+		}
+		for _, stmt := range []string{
+			"ALTER SYSTEM SET default_transaction_read_only = on",
+			"SELECT pg_reload_conf()",
+			"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()",
+		} {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("making the instance read-only: %w", err)
+	}
+	names, err := listDatabases(ctx, pg, secret, blueHost)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		var subscribed bool
+		err := withDatabase(pg, secret, greenHost, name, func(db *sql.DB) error {
+			return db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_subscription s JOIN pg_database d ON d.oid = s.subdbid
+				WHERE s.subname = $1 AND d.datname = current_database())`, blueGreenName).Scan(&subscribed)
+		})
+		if err != nil {
+			return false, err
+		}
+		if !subscribed {
+			continue
+		}
+
+		var caughtUp bool
+		var sequences [][3]interface{}
+		err = withDatabase(pg, secret, blueHost, name, func(db *sql.DB) error {
+			if err := db.QueryRowContext(ctx, "SELECT confirmed_flush_lsn >= pg_current_wal_lsn() FROM pg_replication_slots WHERE slot_name = $1",
+				slotName(name)).Scan(&caughtUp); err != nil || !caughtUp {
+				return err
+			}
+			rows, err := db.QueryContext(ctx, "SELECT schemaname, sequencename, last_value FROM pg_sequences WHERE last_value IS NOT NULL")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var schema, sequence string
+				var value int64
+				if err := rows.Scan(&schema, &sequence, &value); err != nil {
+					return err
+				}
+				sequences = append(sequences, [3]interface{}{schema, sequence, value})
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return false, fmt.Errorf("checking the replication of database %s: %w", name, err)
+		}
+		if !caughtUp {
+			log.FromContext(ctx).Info("Waiting for the subscription to catch up", "Database", name)
+			return false, nil
+		}
+
+		// The slot stays on the old instance, which is read-only now, so it can be switched back to
+		err = withDatabase(pg, secret, greenHost, name, func(db *sql.DB) error {
+			for _, seq := range sequences {
+				if _, err := db.ExecContext(ctx, "SELECT setval(format('%I.%I', $1::text, $2::text)::regclass, $3)", seq[:]...); err != nil {
+					return err
+				}
+			}
+			for _, stmt := range []string{
+				"ALTER SUBSCRIPTION " + blueGreenName + " DISABLE",
+				"ALTER SUBSCRIPTION " + blueGreenName + " SET (slot_name = NONE)",
+				"DROP SUBSCRIPTION " + blueGreenName,
+			} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("switching over database %s: %w", name, err)
+		}
+	}
+
+	// The databases of the new instance were created without the limits of the old ones
+	err = withDatabase(pg, secret, greenHost, "postgres", func(db *sql.DB) error {
+		return setConnectionLimits(ctx, db, pg.Status.Upgrade.ConnectionLimits)
+	})
+	if err != nil {
+		return false, fmt.Errorf("setting the connection limits of version %s: %w", pg.Status.Upgrade.ToVersion, err)
+	}
+	return true, nil
+}
+
+// setConnectionLimits sets the connection limit of each database in limits
+func setConnectionLimits(ctx context.Context, db *sql.DB, limits map[string]int32) error {
+	for name, limit := range limits {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT %d", pq.QuoteIdentifier(name), limit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetBlue makes the instance writable again, restores the connection limits of its databases
+// and drops the publications and replication slots of a blue/green upgrade
+func (r *PostgresReconciler) resetBlue(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret) error {
+	host, err := r.blueHost(ctx, pg)
+	if err != nil {
+		return err
+	}
+	err = withDatabase(pg, secret, host, "postgres", func(db *sql.DB) error {
+		if err := setConnectionLimits(ctx, db, pg.Status.Upgrade.ConnectionLimits); err != nil {
+			return err
+		}
+		for _, stmt := range []string{
+			"ALTER SYSTEM RESET default_transaction_read_only",
+			"SELECT pg_reload_conf()",
+			`SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name LIKE 'blue\_green\_%' AND NOT active`,
+		} {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("resetting the instance: %w", err)
+	}
+	pg.Status.Upgrade.ConnectionLimits = nil
+	names, err := listDatabases(ctx, pg, secret, host)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err := withDatabase(pg, secret, host, name, func(db *sql.DB) error {
+			_, err := db.ExecContext(ctx, "DROP PUBLICATION IF EXISTS "+blueGreenName)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("dropping the publication of database %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// listDatabases returns the databases holding user data on the server at host
+func listDatabases(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret, host string) ([]string, error) {
+	var names []string
+	err := withDatabase(pg, secret, host, "postgres", func(db *sql.DB) error {
+		var err error
+		names, err = queryStrings(ctx, db, "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+		return err
+	})
+	return names, err
+}
+
+// withDatabase runs f with a connection to dbname on the server at host
+func withDatabase(pg *postgresv1beta1.Postgres, secret *corev1.Secret, host, dbname string, f func(*sql.DB) error) error {
+	db, err := openDatabaseAt(pg, secret, host, dbname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(db)
+}
+
+// blueConninfo returns the connection string the new instance subscribes to dbname with
+func blueConninfo(pg *postgresv1beta1.Postgres, secret *corev1.Secret, dbname string) string {
+	sslMode := "disable"
+	if pg.Spec.TLS != nil {
+		sslMode = "require"
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	params := [][2]string{
+		{"host", serviceName(pg) + "." + pg.Namespace + ".svc"},
+		{"port", "5432"},
+		{"dbname", dbname},
+		{"user", string(secret.Data[usernameKey(pg)])},
+		{"password", string(secret.Data[passwordKey(pg)])},
+		{"sslmode", sslMode},
+	}
+	var parts []string
+	for _, p := range params {
+		parts = append(parts, p[0]+"='"+quote.Replace(p[1])+"'")
+	}
+	return strings.Join(parts, " ")
+}
+
+// greenStatefulSet returns the StatefulSet running the new version next to the instance. It has
+// its own data volumes and is only reachable through the Service after the cutover.
+func greenStatefulSet(pg *postgresv1beta1.Postgres, desired *appsv1.StatefulSet, image string) *appsv1.StatefulSet {
+	sts := desired.DeepCopy()
+	labels := map[string]string{"app": greenName(pg)}
+	sts.ObjectMeta = metav1.ObjectMeta{Name: greenName(pg), Namespace: pg.Namespace, Labels: labels}
+	sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	sts.Spec.Template.Labels = labels
+	sts.Spec.Template.Spec.Containers[0].Image = image
+	// The init containers run the postgres image too, they prepare the data volume
+	for i := range sts.Spec.Template.Spec.InitContainers {
+		sts.Spec.Template.Spec.InitContainers[i].Image = image
+	}
+	// Deletion protection covers the volumes of the instance, not those of the new version
+	for i := range sts.Spec.VolumeClaimTemplates {
+		sts.Spec.VolumeClaimTemplates[i].Labels = labels
+	}
+	return sts
+}
+
+// Helper function jobForSchemaCopy returns the Job copying the roles and the schema of every
+// database of the instance to the new instance at greenHost with the tools of image
+func jobForSchemaCopy(pg *postgresv1beta1.Postgres, greenHost, image string) *batchv1.Job {
+	backoffLimit := int32(0)
+	sslMode := "disable"
+	if pg.Spec.TLS != nil {
+		sslMode = "require"
+	}
+	credentialsMode := int32(0440)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      schemaJobName(pg),
+			Namespace: pg.Namespace,
+			Labels:    map[string]string{"app": pg.Name + "-schema"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": pg.Name + "-schema"},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "schema",
+						Image:   image,
+						Command: []string{"/bin/sh", "-c", schemaCopyScript},
+						Env: []corev1.EnvVar{
+							{Name: "BLUE_HOST", Value: serviceName(pg) + "." + pg.Namespace + ".svc"},
+							{Name: "GREEN_HOST", Value: greenHost},
+							{Name: "PGPASSFILE", Value: "/tmp/pgpass"},
+							{Name: "PGSSLMODE", Value: sslMode},
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "credentials",
+								MountPath: credentialsMountPath,
+								ReadOnly:  true,
+							},
+							{
+								Name:      "tmp",
+								MountPath: "/tmp",
+							},
+						},
+					}},
+					Volumes: []corev1.Volume{
+						{
+							Name: "credentials",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: pg.Spec.Auth.SecretRef,
+									Items: []corev1.KeyToPath{
+										{Key: usernameKey(pg), Path: "username"},
+										{Key: passwordKey(pg), Path: "password"},
+									},
+									DefaultMode: &credentialsMode,
+								},
+							},
+						},
+						scratchVolume("tmp"),
+					},
+				},
+			},
+		},
+	}
+}
+
+// schemaCopyScript writes the password from the credentials volume to a password file, copies
+// the roles, creates the missing databases and restores the schema of every database. Roles that
+// exist on the new instance, like the superuser, fail to be created but are still altered, so
+// those errors are ignored.
+const schemaCopyScript = `
+set -eu
+PGUSER="$(cat ` + credentialsMountPath + `/username)"
+export PGUSER
+# : and \ are the separator and the escape character of password files
+(umask 077; printf '*:*:*:*:%s\n' "$(sed 's/[\\:]/\\&/g' ` + credentialsMountPath + `/password)" > "$PGPASSFILE")
+pg_dumpall -h "$BLUE_HOST" --roles-only | psql -h "$GREEN_HOST" -d postgres -q
+existing="$(psql -h "$GREEN_HOST" -d postgres -Atc "SELECT datname FROM pg_database")"
+psql -h "$BLUE_HOST" -d postgres -At -F ' ' \
+  -c "SELECT pg_get_userbyid(datdba), datname FROM pg_database WHERE datallowconn AND NOT datistemplate" |
+while read -r owner db; do
+  if ! printf '%s\n' "$existing" | grep -qFx -- "$db"; then
+    createdb -h "$GREEN_HOST" -O "$owner" -- "$db"
+  fi
+  pg_dump -h "$BLUE_HOST" --schema-only --no-publications --no-subscriptions -d "$db" | psql -h "$GREEN_HOST" -v ON_ERROR_STOP=1 -q -d "$db"
+done
+`
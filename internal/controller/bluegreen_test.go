@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Blue/green upgrades", func() {
+	var (
+		pg  *postgresv1beta1.Postgres
+		sts *appsv1.StatefulSet
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.PostgreSQL.Version = "16"
+		pg.Spec.PostgreSQL.UpgradeStrategy = postgresv1beta1.UpgradeStrategyBlueGreen
+		pg.Status = postgresv1beta1.PostgresStatus{Version: "13", Ready: true}
+		sts = newTestStatefulSet()
+		sts.Annotations = map[string]string{templateHashAnnotation: "logical"}
+		sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "orders"}}
+		sts.Spec.Template = corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "orders"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "postgresql", Image: "postgres:13"}}},
+		}
+	})
+
+	inProgress := func(step postgresv1beta1.UpgradeStep) {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16",
+			Strategy: postgresv1beta1.UpgradeStrategyBlueGreen, Step: step}
+	}
+
+	reconciler := func(objs ...client.Object) *PostgresReconciler {
+		return newTestReconciler(append(objs, pg, sts)...)
+	}
+
+	It("should enable logical decoding", func() {
+		Expect(postgresArgs(pg, nil)).To(ContainElement("wal_level=logical"))
+	})
+
+	It("should wait for the restart with logical decoding before starting", func() {
+		desired := sts.DeepCopy()
+		desired.Annotations[templateHashAnnotation] = "restarted"
+		requeueAfter, err := reconciler().reconcileUpgrade(context.Background(), pg, sts, desired, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+		Expect(pg.Status.Upgrade).To(BeNil())
+	})
+
+	It("should provision the new version while the instance keeps serving", func() {
+		sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data", Labels: dataClaimLabels(pg)}}}
+		sts.Spec.Template.Spec.InitContainers = []corev1.Container{{Name: "pgdata", Image: "postgres:13"}}
+		r := reconciler()
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepProvisioning))
+		Expect(pg.Status.Ready).To(BeTrue())
+
+		_, err = r.reconcileBlueGreen(context.Background(), pg, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		var green appsv1.StatefulSet
+		Expect(r.Get(context.Background(), types.NamespacedName{Name: "orders-green", Namespace: "shop"}, &green)).To(Succeed())
+		Expect(green.Spec.Template.Spec.Containers[0].Image).To(Equal("postgres:16"))
+		Expect(green.Spec.Template.Spec.InitContainers[0].Image).To(Equal("postgres:16"))
+		Expect(green.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "orders-green"}))
+		Expect(green.Spec.VolumeClaimTemplates[0].Labels).To(Equal(map[string]string{"app": "orders-green"}))
+		Expect(*sts.Spec.Replicas).To(Equal(int32(1)))
+	})
+
+	It("should cut over on request and remove the annotation", func() {
+		inProgress(postgresv1beta1.UpgradeStepWaitingForCutover)
+		pg.Annotations = map[string]string{postgresv1beta1.UpgradeActionAnnotation: postgresv1beta1.UpgradeActionCutover}
+		r := reconciler()
+		_, err := r.reconcileBlueGreen(context.Background(), pg, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepCuttingOver))
+
+		var stored postgresv1beta1.Postgres
+		Expect(r.Get(context.Background(), client.ObjectKeyFromObject(pg), &stored)).To(Succeed())
+		Expect(stored.Annotations).NotTo(HaveKey(postgresv1beta1.UpgradeActionAnnotation))
+		Expect(stored.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepCuttingOver))
+	})
+
+	It("should roll back when aborted before the cutover", func() {
+		inProgress(postgresv1beta1.UpgradeStepReplicating)
+		pg.Annotations = map[string]string{postgresv1beta1.UpgradeActionAnnotation: postgresv1beta1.UpgradeActionAbort}
+		_, err := reconciler().reconcileBlueGreen(context.Background(), pg, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepRollingBack))
+		Expect(blueGreenReadOnly(pg)).To(BeTrue())
+	})
+
+	It("should send clients to the new version after the cutover", func() {
+		r := reconciler()
+		Expect(r.serviceForPostgres(pg, nil).Spec.Selector).To(Equal(map[string]string{"app": "orders"}))
+		inProgress(postgresv1beta1.UpgradeStepSwitched)
+		Expect(r.serviceForPostgres(pg, nil).Spec.Selector).To(Equal(map[string]string{"app": "orders-green"}))
+		Expect(r.serviceForPostgres(pg, nil).Labels).To(Equal(map[string]string{"app": "orders"}))
+	})
+
+	It("should retain the volume of the new version before moving it over", func() {
+		inProgress(postgresv1beta1.UpgradeStepPromoting)
+		claim := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data-orders-green-0", Namespace: "shop"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-green"},
+		}
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-green"},
+			Spec:       corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete},
+		}
+		r := reconciler(claim, pv)
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.VolumeName).To(Equal("pv-green"))
+		Expect(pg.Status.Ready).To(BeFalse())
+
+		Expect(r.Get(context.Background(), client.ObjectKeyFromObject(pv), pv)).To(Succeed())
+		Expect(pv.Spec.PersistentVolumeReclaimPolicy).To(Equal(corev1.PersistentVolumeReclaimRetain))
+		Expect(pv.Annotations).To(HaveKeyWithValue(reclaimPolicyAnnotation, "Delete"))
+	})
+
+	It("should pass the password to the schema copy in a password file", func() {
+		pg.Spec.Auth.SecretRef = "orders-credentials"
+		job := jobForSchemaCopy(pg, "orders-green-0.shop.svc", "postgres:16")
+		container := job.Spec.Template.Spec.Containers[0]
+		for _, env := range container.Env {
+			Expect(env.Name).NotTo(Equal("PGPASSWORD"))
+			Expect(env.ValueFrom).To(BeNil())
+		}
+		Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "PGPASSFILE", Value: "/tmp/pgpass"}))
+		Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "credentials", MountPath: credentialsMountPath, ReadOnly: true}))
+		Expect(job.Spec.Template.Spec.Volumes[0].Secret.SecretName).To(Equal("orders-credentials"))
+		Expect(schemaCopyScript).To(ContainSubstring(`> "$PGPASSFILE"`))
+	})
+
+	It("should name a replication slot per database", func() {
+		Expect(slotName("orders")).To(MatchRegexp(`^blue_green_[0-9a-f]{8}$`))
+		Expect(slotName("orders")).NotTo(Equal(slotName("billing")))
+	})
+})
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// configMountPath is where the operator generated configuration is mounted
+	configMountPath = "/etc/postgresql/config"
+
+	// configHashAnnotation holds a hash of the configuration the pods were started with
+	configHashAnnotation = "postgres.snappcloud.io/config-hash"
+
+	hbaFileName = "pg_hba.conf"
+)
+
+func configMapName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-config"
+}
+
+// Helper function configMapForPostgres returns the ConfigMap holding the generated server configuration
+func (r *PostgresReconciler) configMapForPostgres(pg *postgresv1beta1.Postgres) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      configMapName(pg),
+			Namespace: pg.Namespace,
+			Labels:    map[string]string{"app": pg.Name},
+		},
+		Data: map[string]string{
+			hbaFileName: hbaForPostgres(pg),
+		},
+	}
+}
+
+// hbaForPostgres renders pg_hba.conf. The local socket is trusted so the container itself can
+// manage the server, everything else needs a password.
+func hbaForPostgres(pg *postgresv1beta1.Postgres) string {
+	lines := []string{
+		"# Generated by postgresql-operator, do not edit",
+		"local all all trust",
+		"host all all 127.0.0.1/32 md5",
+		"host all all ::1/128 md5",
+	}
+	if pg.Spec.TLS != nil {
+		for _, cc := range pg.Spec.TLS.ClientCertificates {
+			// The webhook only admits roles without quotes or backslashes
+			lines = append(lines, `hostssl all "`+cc.Role+`" all cert`)
+		}
+	}
+	if pg.Spec.TLS != nil && pg.Spec.TLS.Enforce {
+		lines = append(lines,
+			"hostnossl all all all reject",
+			"hostssl all all all md5",
+		)
+	} else {
+		lines = append(lines, "host all all all md5")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// postgresArgs returns the server command line options
+func postgresArgs(pg *postgresv1beta1.Postgres, tlsSecret *corev1.Secret) []string {
+	args := []string{
+		"-c", "hba_file=" + configMountPath + "/" + hbaFileName,
+	}
+	if tlsSecret != nil {
+		args = append(args,
+			"-c", "ssl=on",
+			"-c", "ssl_cert_file="+tlsMountPath+"/"+corev1.TLSCertKey,
+			"-c", "ssl_key_file="+tlsMountPath+"/"+corev1.TLSPrivateKeyKey,
+		)
+		if len(tlsSecret.Data[caCertKey]) > 0 {
+			args = append(args, "-c", "ssl_ca_file="+tlsMountPath+"/"+caCertKey)
+		}
+	}
+
+	if upgradeStrategy(pg) == postgresv1beta1.UpgradeStrategyBlueGreen {
+		// Blue/green upgrades copy the data with logical replication
+		args = append(args, "-c", "wal_level=logical")
+	}
+
+	tuned := tunedParameters(pg)
+	tunedNames := make([]string, 0, len(tuned))
+	for name := range tuned {
+		tunedNames = append(tunedNames, name)
+	}
+	sort.Strings(tunedNames)
+	for _, name := range tunedNames {
+		args = append(args, "-c", name+"="+tuned[name])
+	}
+
+	names := make([]string, 0, len(pg.Spec.PostgreSQL.Parameters))
+	for name := range pg.Spec.PostgreSQL.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-c", name+"="+pg.Spec.PostgreSQL.Parameters[name])
+	}
+	return args
+}
+
+// tunedParameters derives the memory settings from the memory limit of the postgres container the
+// way pgtune does for a mixed workload: a quarter for shared_buffers, three quarters expected to be
+// cached, and work_mem sized so every connection can run a few sorts at once. Settings given in
+// spec.postgresql.parameters are left out.
+func tunedParameters(pg *postgresv1beta1.Postgres) map[string]string {
+	if pg.Spec.Resources == nil {
+		return nil
+	}
+	limit, ok := pg.Spec.Resources.Limits[corev1.ResourceMemory]
+	if !ok || limit.Sign() <= 0 {
+		return nil
+	}
+	memory := limit.Value() / 1024
+	connections := int64(100)
+	if n, err := strconv.ParseInt(pg.Spec.PostgreSQL.Parameters["max_connections"], 10, 64); err == nil && n > 0 {
+		connections = n
+	}
+
+	sharedBuffers := memory / 4
+	tuned := map[string]string{
+		"shared_buffers":       formatKB(sharedBuffers),
+		"effective_cache_size": formatKB(memory * 3 / 4),
+		"maintenance_work_mem": formatKB(min(memory/16, 2*1024*1024)),
+		"work_mem":             formatKB(max((memory-sharedBuffers)/(connections*3), 64)),
+	}
+	for name := range pg.Spec.PostgreSQL.Parameters {
+		delete(tuned, name)
+	}
+	return tuned
+}
+
+// formatKB formats a memory setting given in kB in the largest unit it is a whole number of
+func formatKB(kb int64) string {
+	for _, unit := range []string{"kB", "MB"} {
+		if kb%1024 != 0 {
+			return strconv.FormatInt(kb, 10) + unit
+		}
+		kb /= 1024
+	}
+	return strconv.FormatInt(kb, 10) + "GB"
+}
+
+// reconcileConfigMap creates the ConfigMap or brings its data in line with desired
+func (r *PostgresReconciler) reconcileConfigMap(ctx context.Context, pg *postgresv1beta1.Postgres, desired *corev1.ConfigMap) error {
+	configMap := &corev1.ConfigMap{ObjectMeta: ctrl.ObjectMeta{Name: desired.Name, Namespace: desired.Namespace}}
+	return r.reconcileOwned(ctx, pg, configMap, func() error {
+		configMap.Labels = desired.Labels
+		configMap.Data = desired.Data
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Server configuration", func() {
+	withMemoryLimit := func(limit string) *postgresv1beta1.Postgres {
+		return &postgresv1beta1.Postgres{Spec: postgresv1beta1.PostgresSpec{
+			Resources: &corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(limit)},
+			},
+		}}
+	}
+
+	It("should derive the memory settings from the memory limit", func() {
+		Expect(tunedParameters(withMemoryLimit("4Gi"))).To(Equal(map[string]string{
+			"shared_buffers":       "1GB",
+			"effective_cache_size": "3GB",
+			"maintenance_work_mem": "256MB",
+			"work_mem":             "10485kB",
+		}))
+	})
+
+	It("should keep parameters set in the spec", func() {
+		pg := withMemoryLimit("64Gi")
+		pg.Spec.PostgreSQL.Parameters = map[string]string{"shared_buffers": "8GB", "max_connections": "500"}
+		tuned := tunedParameters(pg)
+		Expect(tuned).NotTo(HaveKey("shared_buffers"))
+		Expect(tuned).To(HaveKeyWithValue("maintenance_work_mem", "2GB"))
+		Expect(tuned).To(HaveKeyWithValue("work_mem", "33554kB"))
+
+		args := postgresArgs(pg, nil)
+		Expect(args).To(ContainElement("shared_buffers=8GB"))
+		Expect(args).To(ContainElement("work_mem=33554kB"))
+	})
+
+	It("should only trust the local socket and ask everyone else for a password", func() {
+		pg := newTestPostgres()
+		Expect(hbaForPostgres(pg)).To(Equal(`# Generated by postgresql-operator, do not edit
+local all all trust
+host all all 127.0.0.1/32 md5
+host all all ::1/128 md5
+host all all all md5
+`))
+		Expect(postgresArgs(pg, nil)).To(ContainElement("hba_file=" + configMountPath + "/" + hbaFileName))
+		Expect((&PostgresReconciler{}).configMapForPostgres(pg).Data).To(HaveKeyWithValue(hbaFileName, hbaForPostgres(pg)))
+	})
+
+	It("should let roles with a client certificate authenticate with it before the password rules", func() {
+		pg := newTestPostgres()
+		pg.Spec.TLS = &postgresv1beta1.TLS{
+			Mode:               postgresv1beta1.TLSModeOperator,
+			ClientCertificates: []postgresv1beta1.ClientCertificate{{Role: "billing"}, {Role: "Reporting_Jobs"}},
+		}
+		Expect(strings.Split(hbaForPostgres(pg), "\n")[4:]).To(Equal([]string{
+			`hostssl all "billing" all cert`,
+			`hostssl all "Reporting_Jobs" all cert`,
+			"host all all all md5",
+			"",
+		}))
+	})
+
+	It("should reject connections without SSL when it is enforced", func() {
+		pg := newTestPostgres()
+		pg.Spec.TLS = &postgresv1beta1.TLS{
+			Mode:               postgresv1beta1.TLSModeOperator,
+			Enforce:            true,
+			ClientCertificates: []postgresv1beta1.ClientCertificate{{Role: "billing"}},
+		}
+		Expect(strings.Split(hbaForPostgres(pg), "\n")[4:]).To(Equal([]string{
+			`hostssl all "billing" all cert`,
+			"hostnossl all all all reject",
+			"hostssl all all all md5",
+			"",
+		}))
+	})
+
+	It("should not tune without a memory limit", func() {
+		pg := withMemoryLimit("1Gi")
+		pg.Spec.Resources.Limits = nil
+		Expect(tunedParameters(pg)).To(BeEmpty())
+	})
+})
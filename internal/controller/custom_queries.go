@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// customQueriesField is the field index used to look up Postgres objects by their query ConfigMaps
+	customQueriesField = ".spec.monitoring.customQueries"
+
+	exporterQueriesMountPath = "/etc/postgres-exporter/queries"
+
+	// queriesHashAnnotation holds a hash of the custom queries the exporters were started with
+	queriesHashAnnotation = "postgres.snappcloud.io/queries-hash"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// databaseNamePattern restricts target databases to names usable as ConfigMap keys
+	databaseNamePattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+)
+
+// builtinQueries are always loaded into the exporter of the instance database. They back default
+// alerts that need metrics postgres_exporter does not collect itself.
+const builtinQueries = `
+pg_database_wraparound:
+  query: "SELECT datname, age(datfrozenxid) AS age_datfrozenxid FROM pg_database WHERE datallowconn"
+  metrics:
+    - datname:
+        usage: LABEL
+        description: Database name
+    - age_datfrozenxid:
+        usage: GAUGE
+        description: Age of the oldest unfrozen transaction ID in the database
+`
+
+// customQuery is a query definition as written by users. It is the postgres_exporter query format
+// plus the databases the query runs in.
+type customQuery struct {
+	Query string `json:"query"`
+	// Databases defaults to the instance database
+	Databases []string                       `json:"databases,omitempty"`
+	Metrics   []map[string]customQueryColumn `json:"metrics"`
+}
+
+type customQueryColumn struct {
+	Usage       string `json:"usage"`
+	Description string `json:"description,omitempty"`
+}
+
+// exporterQuery is a query in the format postgres_exporter loads through --extend.query-path
+type exporterQuery struct {
+	Query   string                         `json:"query"`
+	Metrics []map[string]customQueryColumn `json:"metrics"`
+}
+
+func customQueriesConfigMapName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-monitoring-queries"
+}
+
+// validate checks a single query definition
+func (q customQuery) validate(name string) error {
+	if !metricNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	if q.Query == "" {
+		return fmt.Errorf("metric %s: query must not be empty", name)
+	}
+	values := 0
+	for _, columns := range q.Metrics {
+		for column, def := range columns {
+			if !metricNamePattern.MatchString(column) {
+				return fmt.Errorf("metric %s: invalid column name %q", name, column)
+			}
+			switch def.Usage {
+			case "LABEL", "DISCARD":
+			case "COUNTER", "GAUGE", "HISTOGRAM", "MAPPEDMETRIC", "DURATION":
+				values++
+			default:
+				return fmt.Errorf("metric %s: column %s has unsupported usage %q", name, column, def.Usage)
+			}
+		}
+	}
+	if values == 0 {
+		return fmt.Errorf("metric %s: at least one value column is required", name)
+	}
+	for _, db := range q.Databases {
+		if !databaseNamePattern.MatchString(db) {
+			return fmt.Errorf("metric %s: unsupported database name %q", name, db)
+		}
+	}
+	return nil
+}
+
+// parseCustomQueries validates the query definitions in data and groups them by target database
+func parseCustomQueries(data []byte, defaultDatabase string, byDatabase map[string]map[string]exporterQuery) error {
+	var queries map[string]customQuery
+	if err := yaml.UnmarshalStrict(data, &queries); err != nil {
+		return err
+	}
+	for name, q := range queries {
+		if err := q.validate(name); err != nil {
+			return err
+		}
+		databases := q.Databases
+		if len(databases) == 0 {
+			databases = []string{defaultDatabase}
+		}
+		for _, db := range databases {
+			if byDatabase[db] == nil {
+				byDatabase[db] = map[string]exporterQuery{}
+			}
+			if _, ok := byDatabase[db][name]; ok {
+				return fmt.Errorf("metric %s is defined more than once for database %s", name, db)
+			}
+			byDatabase[db][name] = exporterQuery{Query: q.Query, Metrics: q.Metrics}
+		}
+	}
+	return nil
+}
+
+// reconcileCustomQueries loads and validates the referenced query ConfigMaps and renders them,
+// together with the builtin queries, into a ConfigMap with one exporter query file per database.
+// It returns that ConfigMap, or nil when monitoring is disabled.
+func (r *PostgresReconciler) reconcileCustomQueries(ctx context.Context, pg *postgresv1beta1.Postgres) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{ObjectMeta: ctrl.ObjectMeta{Name: customQueriesConfigMapName(pg), Namespace: pg.Namespace}}
+	if !monitoringEnabled(pg) {
+		return nil, r.deleteOwned(ctx, pg, configMap)
+	}
+
+	byDatabase := map[string]map[string]exporterQuery{}
+	if err := parseCustomQueries([]byte(builtinQueries), pg.Spec.Auth.Database, byDatabase); err != nil {
+		return nil, err
+	}
+	for _, ref := range pg.Spec.Monitoring.CustomQueries {
+		var source corev1.ConfigMap
+		if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: pg.Namespace}, &source); err != nil {
+			if ref.Optional != nil && *ref.Optional && client.IgnoreNotFound(err) == nil {
+				continue
+			}
+			return nil, err
+		}
+		data, ok := source.Data[ref.Key]
+		if !ok {
+			if ref.Optional != nil && *ref.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("key %q not found in ConfigMap %s", ref.Key, ref.Name)
+		}
+		if err := parseCustomQueries([]byte(data), pg.Spec.Auth.Database, byDatabase); err != nil {
+			return nil, fmt.Errorf("invalid custom queries in ConfigMap %s key %s: %w", ref.Name, ref.Key, err)
+		}
+	}
+
+	rendered := map[string]string{}
+	for db, queries := range byDatabase {
+		out, err := yaml.Marshal(queries)
+		if err != nil {
+			return nil, err
+		}
+		rendered[db+".yaml"] = string(out)
+	}
+
+	return configMap, r.reconcileOwned(ctx, pg, configMap, func() error {
+		configMap.Labels = map[string]string{"app": pg.Name}
+		configMap.Data = rendered
+		return nil
+	})
+}
+
+// exporterDatabases returns the databases an exporter container is run for. The first one is the
+// instance database, whose exporter also serves the default metrics.
+func exporterDatabases(pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) []string {
+	databases := []string{pg.Spec.Auth.Database}
+	if queries == nil {
+		return databases
+	}
+	var extra []string
+	for key := range queries.Data {
+		if db := strings.TrimSuffix(key, ".yaml"); db != pg.Spec.Auth.Database {
+			extra = append(extra, db)
+		}
+	}
+	sort.Strings(extra)
+	return append(databases, extra...)
+}
+
+// exporterPortName returns the name of the metrics port of the i-th exporter container
+func exporterPortName(i int) string {
+	if i == 0 {
+		return "metrics"
+	}
+	return fmt.Sprintf("metrics-%d", i)
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Custom exporter queries", func() {
+	It("should group queries by target database", func() {
+		data := []byte(`
+pg_orders:
+  query: "SELECT count(*) AS total FROM orders"
+  databases: [shop]
+  metrics:
+    - total:
+        usage: GAUGE
+pg_sessions:
+  query: "SELECT count(*) AS active FROM pg_stat_activity"
+  metrics:
+    - active:
+        usage: GAUGE
+`)
+		byDatabase := map[string]map[string]exporterQuery{}
+		Expect(parseCustomQueries(data, "app", byDatabase)).To(Succeed())
+		Expect(byDatabase).To(HaveKey("shop"))
+		Expect(byDatabase["shop"]).To(HaveKey("pg_orders"))
+		Expect(byDatabase["app"]).To(HaveKey("pg_sessions"))
+	})
+
+	It("should accept the builtin queries", func() {
+		byDatabase := map[string]map[string]exporterQuery{}
+		Expect(parseCustomQueries([]byte(builtinQueries), "app", byDatabase)).To(Succeed())
+		Expect(byDatabase["app"]).To(HaveKey("pg_database_wraparound"))
+	})
+
+	It("should reject invalid queries", func() {
+		for _, data := range []string{
+			`bad-name: {query: "SELECT 1 AS v", metrics: [{v: {usage: GAUGE}}]}`,
+			`pg_empty: {query: "", metrics: [{v: {usage: GAUGE}}]}`,
+			`pg_labels: {query: "SELECT 1 AS v", metrics: [{v: {usage: LABEL}}]}`,
+			`pg_usage: {query: "SELECT 1 AS v", metrics: [{v: {usage: SUM}}]}`,
+			`pg_unknown: {query: "SELECT 1 AS v", master: true, metrics: [{v: {usage: GAUGE}}]}`,
+		} {
+			Expect(parseCustomQueries([]byte(data), "app", map[string]map[string]exporterQuery{})).NotTo(Succeed(), data)
+		}
+	})
+
+	It("should reject a metric defined twice for the same database", func() {
+		byDatabase := map[string]map[string]exporterQuery{}
+		data := []byte(`pg_v: {query: "SELECT 1 AS v", metrics: [{v: {usage: GAUGE}}]}`)
+		Expect(parseCustomQueries(data, "app", byDatabase)).To(Succeed())
+		Expect(parseCustomQueries(data, "app", byDatabase)).NotTo(Succeed())
+	})
+})
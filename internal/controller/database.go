@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// openDatabase connects to dbname on the instance as the user from the credentials Secret.
+// The caller must close the returned handle.
+func openDatabase(pg *postgresv1beta1.Postgres, secret *corev1.Secret, dbname string) (*sql.DB, error) {
+	return openDatabaseAt(pg, secret, serviceName(pg)+"."+pg.Namespace+".svc", dbname)
+}
+
+// openDatabaseAt connects to dbname on the server at host, like openDatabase
+func openDatabaseAt(pg *postgresv1beta1.Postgres, secret *corev1.Secret, host, dbname string) (*sql.DB, error) {
+	sslMode := "disable"
+	if pg.Spec.TLS != nil {
+		sslMode = "require"
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(string(secret.Data[usernameKey(pg)]), string(secret.Data[passwordKey(pg)])),
+		Host:     net.JoinHostPort(host, "5432"),
+		Path:     dbname,
+		RawQuery: url.Values{"sslmode": []string{sslMode}, "connect_timeout": []string{"10"}}.Encode(),
+	}
+	return sql.Open("postgres", dsn.String())
+}
+
+// queryStrings returns the single text column of every row query returns
+func queryStrings(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// ensureLoginRole creates or updates an operator managed role so it can log in with password
+func ensureLoginRole(ctx context.Context, db *sql.DB, role, password string) error {
+	if err := ensureRole(ctx, db, role); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "ALTER ROLE "+pq.QuoteIdentifier(role)+" WITH LOGIN PASSWORD "+pq.QuoteLiteral(password)); err != nil {
+		return fmt.Errorf("updating role %s: %w", role, err)
+	}
+	return nil
+}
+
+// generatePassword returns a random alphanumeric password
+func generatePassword() (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	password := make([]byte, 32)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// ensureRole creates a login role when it does not exist yet
+func ensureRole(ctx context.Context, db *sql.DB, role string) error {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "CREATE ROLE "+pq.QuoteIdentifier(role)+" LOGIN"); err != nil {
+		return fmt.Errorf("creating role %s: %w", role, err)
+	}
+	return nil
+}
+
+// poolerAuthSQL creates the SECURITY DEFINER function PgBouncer's auth_query calls, so the auth
+// user can look up password hashes without being able to read pg_shadow itself.
+const poolerAuthSQL = `
+CREATE SCHEMA IF NOT EXISTS pgbouncer;
+CREATE OR REPLACE FUNCTION pgbouncer.get_auth(p_usename TEXT)
+RETURNS TABLE(usename name, passwd text)
+LANGUAGE sql SECURITY DEFINER SET search_path = pg_catalog AS
+$$ SELECT usename, passwd FROM pg_catalog.pg_shadow WHERE usename = p_usename $$;
+REVOKE ALL ON FUNCTION pgbouncer.get_auth(text) FROM PUBLIC;
+GRANT USAGE ON SCHEMA pgbouncer TO ` + poolerAuthUser + `;
+GRANT EXECUTE ON FUNCTION pgbouncer.get_auth(text) TO ` + poolerAuthUser + `;
+`
+
+// reconcileDatabase ensures the roles and objects required by the spec exist in the running instance
+func (r *PostgresReconciler) reconcileDatabase(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret) error {
+	var roles []string
+	if pg.Spec.TLS != nil {
+		for _, cc := range pg.Spec.TLS.ClientCertificates {
+			roles = append(roles, cc.Role)
+		}
+	}
+	if len(roles) == 0 && !poolerEnabled(pg) && !monitoringEnabled(pg) {
+		return nil
+	}
+
+	db, err := openDatabase(pg, secret, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, role := range roles {
+		if err := ensureRole(ctx, db, role); err != nil {
+			return err
+		}
+	}
+
+	if monitoringEnabled(pg) {
+		var monitoringSecret corev1.Secret
+		if err := r.Get(ctx, types.NamespacedName{Name: monitoringSecretName(pg), Namespace: pg.Namespace}, &monitoringSecret); err != nil {
+			return err
+		}
+		if err := ensureLoginRole(ctx, db, monitoringUser, string(monitoringSecret.Data[monitoringPasswordSecret])); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "GRANT pg_monitor TO "+monitoringUser); err != nil {
+			return fmt.Errorf("granting pg_monitor: %w", err)
+		}
+	}
+
+	if poolerEnabled(pg) {
+		var poolerSecret corev1.Secret
+		if err := r.Get(ctx, types.NamespacedName{Name: poolerName(pg), Namespace: pg.Namespace}, &poolerSecret); err != nil {
+			return err
+		}
+		if err := ensureLoginRole(ctx, db, poolerAuthUser, string(poolerSecret.Data["password"])); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, poolerAuthSQL); err != nil {
+			return fmt.Errorf("creating pooler auth function: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	postgresFinalizer = "postgres.finalizer"
+
+	// deletionPollInterval is how often the finalizer checks on pods and snapshots it waits for
+	deletionPollInterval = 5 * time.Second
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+func deletionPolicy(pg *postgresv1beta1.Postgres) postgresv1beta1.DeletionPolicy {
+	if pg.Spec.Deletion.Policy == "" {
+		return postgresv1beta1.DeletionPolicyRetain
+	}
+	return pg.Spec.Deletion.Policy
+}
+
+// finalSnapshotName returns the name of the VolumeSnapshot taken of a data volume on deletion. It
+// includes part of the instance UID so a later instance with the same name does not reuse it.
+func finalSnapshotName(pg *postgresv1beta1.Postgres, claim string) string {
+	uid := string(pg.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf("%s-final-%s", claim, uid)
+}
+
+// finalizerPostgres runs one step of the cleanup of a deleted instance. It never blocks: while a
+// step waits on the cluster it returns the delay after which it wants to be called again, and it
+// returns zero once the finalizer can be removed.
+//
+// The steps are: remove the new instance of a blue/green upgrade, stop the StatefulSet and wait for its pods to terminate, snapshot the data
+// volumes and wait for the snapshots to be ready when the policy is Snapshot, delete the data
+// volumes unless the policy is Retain, and delete the Service.
+func (r *PostgresReconciler) finalizerPostgres(ctx context.Context, pg *postgresv1beta1.Postgres) (time.Duration, error) {
+	logger := log.FromContext(ctx)
+
+	// The instance of an unfinished blue/green upgrade holds no data of its own
+	if err := r.removeGreen(ctx, pg); err != nil {
+		return 0, err
+	}
+
+	var statefulset appsv1.StatefulSet
+	err := r.Get(ctx, types.NamespacedName{Name: pg.Name, Namespace: pg.Namespace}, &statefulset)
+	if err == nil {
+		if statefulset.DeletionTimestamp.IsZero() {
+			logger.Info("Deleting StatefulSet", "StatefulSet.Namespace", statefulset.Namespace, "StatefulSet.Name", statefulset.Name)
+			if err := r.Delete(ctx, &statefulset, client.PropagationPolicy("Foreground")); client.IgnoreNotFound(err) != nil {
+				return 0, err
+			}
+		}
+		return deletionPollInterval, nil
+	} else if !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+
+	// The volumes must not be in use while they are snapshotted or deleted
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels{"app": pg.Name}); err != nil {
+		return 0, err
+	}
+	if len(pods.Items) > 0 {
+		logger.Info("Waiting for pods to terminate", "Pods", len(pods.Items))
+		return deletionPollInterval, nil
+	}
+
+	claims, err := r.dataClaims(ctx, pg)
+	if err != nil {
+		return 0, err
+	}
+
+	switch deletionPolicy(pg) {
+	case postgresv1beta1.DeletionPolicySnapshot:
+		ready, err := r.ensureSnapshots(ctx, pg, claims, func(claim string) string { return finalSnapshotName(pg, claim) })
+		if err != nil {
+			return 0, err
+		}
+		if !ready {
+			return deletionPollInterval, nil
+		}
+		fallthrough
+	case postgresv1beta1.DeletionPolicyDelete:
+		for i := range claims {
+			if !claims[i].DeletionTimestamp.IsZero() {
+				continue
+			}
+			r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleting, "Deleting volume %s", claims[i].Name)
+			if err := r.Delete(ctx, &claims[i]); client.IgnoreNotFound(err) != nil {
+				return 0, err
+			}
+		}
+	case postgresv1beta1.DeletionPolicyRetain:
+		for _, claim := range claims {
+			r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleting, "Retaining volume %s", claim.Name)
+		}
+	}
+
+	for _, name := range []string{serviceName(pg), legacyServiceName} {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace}}
+		if err := r.deleteOwned(ctx, pg, service); err != nil {
+			return 0, err
+		}
+	}
+	failovers.DeleteLabelValues(pg.Namespace, pg.Name)
+	return 0, nil
+}
+
+// dataClaims returns the data volume claims created from the StatefulSet volume claim template
+func (r *PostgresReconciler) dataClaims(ctx context.Context, pg *postgresv1beta1.Postgres) ([]corev1.PersistentVolumeClaim, error) {
+	var list corev1.PersistentVolumeClaimList
+	if err := r.List(ctx, &list, client.InNamespace(pg.Namespace), client.MatchingLabels{"app": pg.Name}); err != nil {
+		return nil, err
+	}
+	var claims []corev1.PersistentVolumeClaim
+	for _, claim := range list.Items {
+		if strings.HasPrefix(claim.Name, "data-"+pg.Name+"-") {
+			claims = append(claims, claim)
+		}
+	}
+	return claims, nil
+}
+
+// ensureSnapshots creates a VolumeSnapshot named by snapshotName of every data volume and reports
+// whether all of them are ready to use. The snapshots are deliberately not owned by the instance,
+// so they outlive it.
+func (r *PostgresReconciler) ensureSnapshots(ctx context.Context, pg *postgresv1beta1.Postgres, claims []corev1.PersistentVolumeClaim,
+	snapshotName func(claim string) string) (bool, error) {
+	if _, err := r.RESTMapper().RESTMapping(volumeSnapshotGVK.GroupKind(), volumeSnapshotGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			r.Recorder.Event(pg, corev1.EventTypeWarning, eventSnapshotFailed, "The VolumeSnapshot CRDs are not installed")
+		}
+		return false, err
+	}
+
+	ready := true
+	for _, claim := range claims {
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		err := r.Get(ctx, types.NamespacedName{Name: snapshotName(claim.Name), Namespace: pg.Namespace}, snapshot)
+		if apierrors.IsNotFound(err) {
+			snapshot.SetName(snapshotName(claim.Name))
+			snapshot.SetNamespace(pg.Namespace)
+			snapshot.SetLabels(map[string]string{"app": pg.Name})
+			spec := map[string]interface{}{
+				"source": map[string]interface{}{"persistentVolumeClaimName": claim.Name},
+			}
+			if pg.Spec.Deletion.VolumeSnapshotClassName != "" {
+				spec["volumeSnapshotClassName"] = pg.Spec.Deletion.VolumeSnapshotClassName
+			}
+			if err := unstructured.SetNestedField(snapshot.Object, spec, "spec"); err != nil {
+				return false, err
+			}
+			if err := r.Create(ctx, snapshot); err != nil {
+				return false, err
+			}
+			r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventSnapshotting, "Taking VolumeSnapshot %s of volume %s", snapshot.GetName(), claim.Name)
+			ready = false
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+			r.Recorder.Eventf(pg, corev1.EventTypeWarning, eventSnapshotFailed, "VolumeSnapshot %s failed: %s", snapshot.GetName(), message)
+			return false, fmt.Errorf("VolumeSnapshot %s failed: %s", snapshot.GetName(), message)
+		}
+		if readyToUse, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !readyToUse {
+			ready = false
+		}
+	}
+	return ready, nil
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Deletion", func() {
+	var (
+		pg    *postgresv1beta1.Postgres
+		claim *corev1.PersistentVolumeClaim
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.UID = "0123456789abcdef"
+		claim = &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name: "data-orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"},
+		}}
+	})
+
+	// reconciler serves VolumeSnapshots like a cluster with the snapshot CRDs installed
+	reconciler := func(objs ...client.Object) *PostgresReconciler {
+		r := newTestReconciler()
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(volumeSnapshotGVK, meta.RESTScopeNamespace)
+		r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).
+			WithObjects(append(objs, pg)...).Build()
+		return r
+	}
+
+	claimExists := func(r *PostgresReconciler) bool {
+		err := r.Get(context.Background(), client.ObjectKeyFromObject(claim), &corev1.PersistentVolumeClaim{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	It("should not wait for the StatefulSet and its pods to go away", func() {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"}}}
+		r := reconciler(newTestStatefulSet(), pod)
+		requeueAfter, err := r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(deletionPollInterval))
+		err = r.Get(context.Background(), types.NamespacedName{Name: "orders", Namespace: "shop"}, &appsv1.StatefulSet{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		requeueAfter, err = r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(deletionPollInterval))
+	})
+
+	It("should keep the data volumes with the Retain policy", func() {
+		pg.Spec.Deletion.Policy = postgresv1beta1.DeletionPolicyRetain
+		r := reconciler(claim)
+		requeueAfter, err := r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+		Expect(claimExists(r)).To(BeTrue())
+	})
+
+	It("should delete the data volumes with the Delete policy", func() {
+		pg.Spec.Deletion.Policy = postgresv1beta1.DeletionPolicyDelete
+		r := reconciler(claim)
+		requeueAfter, err := r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+		Expect(claimExists(r)).To(BeFalse())
+	})
+
+	It("should delete the data volumes once their snapshot is ready with the Snapshot policy", func() {
+		pg.Spec.Deletion.Policy = postgresv1beta1.DeletionPolicySnapshot
+		r := reconciler(claim)
+		requeueAfter, err := r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(deletionPollInterval))
+		Expect(claimExists(r)).To(BeTrue())
+
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		key := types.NamespacedName{Name: "data-orders-0-final-01234567", Namespace: "shop"}
+		Expect(r.Get(context.Background(), key, snapshot)).To(Succeed())
+		source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+		Expect(source).To(Equal("data-orders-0"))
+		Expect(unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse")).To(Succeed())
+		Expect(r.Update(context.Background(), snapshot)).To(Succeed())
+
+		requeueAfter, err = r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+		Expect(claimExists(r)).To(BeFalse())
+	})
+
+	It("should delete the Services the instance owns", func() {
+		var services []client.Object
+		for _, name := range []string{"orders", legacyServiceName} {
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"}}
+			Expect(ctrl.SetControllerReference(pg, service, newTestReconciler().Scheme)).To(Succeed())
+			services = append(services, service)
+		}
+		r := reconciler(services...)
+		_, err := r.finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		for _, service := range services {
+			err := r.Get(context.Background(), client.ObjectKeyFromObject(service), &corev1.Service{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		}
+	})
+
+	It("should name the final snapshot after a short UID", func() {
+		pg.UID = "1234"
+		Expect(finalSnapshotName(pg, "data-orders-0")).To(Equal("data-orders-0-final-1234"))
+	})
+})
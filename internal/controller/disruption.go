@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+
+// primaryPDBName is the PodDisruptionBudget of the primary pod
+func primaryPDBName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-primary"
+}
+
+// standbysPDBName is the PodDisruptionBudget of the standby pods
+func standbysPDBName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-standbys"
+}
+
+// reconcilePodDisruptionBudgets keeps a PodDisruptionBudget for the primary, which blocks its
+// eviction with spec.disruption.blockPrimaryEviction, and one letting a single standby be evicted
+// at a time while the StatefulSet runs standbys.
+func (r *PostgresReconciler) reconcilePodDisruptionBudgets(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet) error {
+	primary := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: primaryPDBName(pg), Namespace: pg.Namespace}}
+	if err := r.reconcileOwned(ctx, pg, primary, func() error {
+		primary.Labels = map[string]string{"app": pg.Name}
+		primary.Spec = primaryPDBSpec(pg)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	standbys := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: standbysPDBName(pg), Namespace: pg.Namespace}}
+	if *sts.Spec.Replicas <= 1 {
+		return r.deleteOwned(ctx, pg, standbys)
+	}
+	return r.reconcileOwned(ctx, pg, standbys, func() error {
+		standbys.Labels = map[string]string{"app": pg.Name}
+		standbys.Spec = standbysPDBSpec(pg)
+		return nil
+	})
+}
+
+// primaryPDBSpec selects the pod with ordinal 0, which runs the primary
+func primaryPDBSpec(pg *postgresv1beta1.Postgres) policyv1.PodDisruptionBudgetSpec {
+	maxUnavailable := intstr.FromInt32(1)
+	if pg.Spec.Disruption.BlockPrimaryEviction {
+		maxUnavailable = intstr.FromInt32(0)
+	}
+	return policyv1.PodDisruptionBudgetSpec{
+		MaxUnavailable: &maxUnavailable,
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{
+			"app":                          pg.Name,
+			appsv1.StatefulSetPodNameLabel: pg.Name + "-0",
+		}},
+	}
+}
+
+// standbysPDBSpec selects every pod of the instance but the primary
+func standbysPDBSpec(pg *postgresv1beta1.Postgres) policyv1.PodDisruptionBudgetSpec {
+	maxUnavailable := intstr.FromInt32(1)
+	return policyv1.PodDisruptionBudgetSpec{
+		MaxUnavailable: &maxUnavailable,
+		Selector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"app": pg.Name},
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      appsv1.StatefulSetPodNameLabel,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{pg.Name + "-0"},
+			}},
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Disruption budgets", func() {
+	var (
+		pg  *postgresv1beta1.Postgres
+		sts *appsv1.StatefulSet
+		r   *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		sts = newTestStatefulSet()
+		r = newTestReconciler(pg)
+	})
+
+	getPDB := func(name string) (*policyv1.PodDisruptionBudget, error) {
+		var pdb policyv1.PodDisruptionBudget
+		err := r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "shop"}, &pdb)
+		return &pdb, err
+	}
+
+	It("should let a single primary be evicted unless blocked", func() {
+		Expect(r.reconcilePodDisruptionBudgets(context.Background(), pg, sts)).To(Succeed())
+		primary, err := getPDB("orders-primary")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*primary.Spec.MaxUnavailable).To(Equal(intstr.FromInt32(1)))
+		Expect(primary.Spec.Selector.MatchLabels).To(HaveKeyWithValue(appsv1.StatefulSetPodNameLabel, "orders-0"))
+		_, err = getPDB("orders-standbys")
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		pg.Spec.Disruption.BlockPrimaryEviction = true
+		Expect(r.reconcilePodDisruptionBudgets(context.Background(), pg, sts)).To(Succeed())
+		primary, err = getPDB("orders-primary")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*primary.Spec.MaxUnavailable).To(Equal(intstr.FromInt32(0)))
+	})
+
+	It("should evict one standby at a time", func() {
+		replicas := int32(3)
+		sts.Spec.Replicas = &replicas
+		Expect(r.reconcilePodDisruptionBudgets(context.Background(), pg, sts)).To(Succeed())
+		standbys, err := getPDB("orders-standbys")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*standbys.Spec.MaxUnavailable).To(Equal(intstr.FromInt32(1)))
+		Expect(standbys.Spec.Selector.MatchExpressions[0].Values).To(Equal([]string{"orders-0"}))
+
+		replicas = 1
+		Expect(r.reconcilePodDisruptionBudgets(context.Background(), pg, sts)).To(Succeed())
+		_, err = getPDB("orders-standbys")
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,22 @@
+package controller
+
+// Reasons of the Events recorded on Postgres objects
+const (
+	eventCreated        = "Created"
+	eventSecretMissing  = "SecretMissing"
+	eventInvalidSpec    = "InvalidSpec"
+	eventReady          = "Ready"
+	eventNotReady       = "NotReady"
+	eventFailover       = "Failover"
+	eventResizeRejected = "ResizeRejected"
+	eventRestarting     = "Restarting"
+	eventRollingUpdate  = "RollingUpdate"
+	eventUpdated        = "Updated"
+	eventUpgrading      = "Upgrading"
+	eventUpgradeFailed  = "UpgradeFailed"
+	eventCutover        = "Cutover"
+	eventDeleting       = "Deleting"
+	eventDeleted        = "Deleted"
+	eventSnapshotting   = "Snapshotting"
+	eventSnapshotFailed = "SnapshotFailed"
+)
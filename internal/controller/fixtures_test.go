@@ -0,0 +1,46 @@
+package controller
+
+import (
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// Fixtures shared by the specs that run against a fake client instead of envtest
+
+// newTestPostgres returns the instance "orders" in the namespace "shop"
+func newTestPostgres() *postgresv1beta1.Postgres {
+	return &postgresv1beta1.Postgres{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop", UID: "1234"}}
+}
+
+// newTestStatefulSet returns the StatefulSet of newTestPostgres with a single pod
+func newTestStatefulSet() *appsv1.StatefulSet {
+	replicas := int32(1)
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+}
+
+// newTestReconciler returns a reconciler whose fake client holds objs and serves the status of
+// Postgres objects as a subresource, like the API server does
+func newTestReconciler(objs ...client.Object) *PostgresReconciler {
+	scheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	Expect(postgresv1beta1.AddToScheme(scheme)).To(Succeed())
+	return &PostgresReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(objs...).
+			WithStatusSubresource(&postgresv1beta1.Postgres{}).
+			Build(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(10),
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// imageCatalogRefField is the field index used to look up Postgres objects by their ImageCatalog
+const imageCatalogRefField = ".spec.imageCatalogRef.name"
+
+// +kubebuilder:rbac:groups=postgres.snappcloud.io,resources=imagecatalogs,verbs=get;list;watch
+
+// resolveImage returns the postgres image of version. spec.image applies to the spec version;
+// while a major upgrade has not reached it yet, the old version keeps the image it runs. Otherwise
+// the image comes from the referenced ImageCatalog, read on every reconcile so catalog changes
+// roll out, or is the official image tagged with the version. The Extensions condition reports
+// whether a catalog image provides the preloaded libraries.
+func (r *PostgresReconciler) resolveImage(ctx context.Context, pg *postgresv1beta1.Postgres, version string) (string, error) {
+	if pg.Spec.Image != "" {
+		if version == pg.Spec.PostgreSQL.Version {
+			return pg.Spec.Image, r.removeExtensionsCondition(ctx, pg)
+		}
+		if version == pg.Status.Version && pg.Status.Image != "" {
+			return pg.Status.Image, r.removeExtensionsCondition(ctx, pg)
+		}
+	}
+
+	ref := pg.Spec.ImageCatalogRef
+	if ref == nil {
+		return "postgres:" + version, r.removeExtensionsCondition(ctx, pg)
+	}
+	var catalog postgresv1beta1.ImageCatalog
+	if err := r.Get(ctx, types.NamespacedName{Name: ref.Name}, &catalog); err != nil {
+		return "", fmt.Errorf("getting ImageCatalog %s: %w", ref.Name, err)
+	}
+	major := postgresv1beta1.MajorVersion(version)
+	entry := catalog.Spec.Image(major)
+	if entry == nil {
+		return "", fmt.Errorf("ImageCatalog %s has no image for major version %d", ref.Name, major)
+	}
+	condition := metav1.Condition{
+		Type:               postgresv1beta1.ConditionExtensions,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Provided",
+		Message:            fmt.Sprintf("ImageCatalog %s provides the preloaded libraries for version %d", ref.Name, major),
+		ObservedGeneration: pg.Generation,
+	}
+	if missing := missingExtensions(pg, entry); len(missing) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Missing"
+		condition.Message = fmt.Sprintf("shared_preload_libraries lists %s, which ImageCatalog %s does not provide for version %d",
+			strings.Join(missing, ", "), ref.Name, major)
+	}
+	if err := r.setExtensionsCondition(ctx, pg, condition); err != nil {
+		return "", err
+	}
+	return entry.Image, nil
+}
+
+// setExtensionsCondition stores the Extensions condition. The warning Event is only recorded when
+// the condition turns false or the missing libraries change, not on every reconcile.
+func (r *PostgresReconciler) setExtensionsCondition(ctx context.Context, pg *postgresv1beta1.Postgres, condition metav1.Condition) error {
+	previous := meta.FindStatusCondition(pg.Status.Conditions, postgresv1beta1.ConditionExtensions)
+	changed := previous == nil || previous.Status != condition.Status || previous.Message != condition.Message
+	if !meta.SetStatusCondition(&pg.Status.Conditions, condition) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, pg); err != nil {
+		return err
+	}
+	if condition.Status == metav1.ConditionFalse && changed {
+		r.Recorder.Event(pg, corev1.EventTypeWarning, eventInvalidSpec, condition.Message)
+	}
+	return nil
+}
+
+// removeExtensionsCondition drops the Extensions condition once no catalog image is used
+func (r *PostgresReconciler) removeExtensionsCondition(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	if !meta.RemoveStatusCondition(&pg.Status.Conditions, postgresv1beta1.ConditionExtensions) {
+		return nil
+	}
+	return r.Status().Update(ctx, pg)
+}
+
+// missingExtensions returns the preloaded libraries the catalog image does not list
+func missingExtensions(pg *postgresv1beta1.Postgres, entry *postgresv1beta1.CatalogImage) []string {
+	provided := map[string]bool{}
+	for _, extension := range entry.Extensions {
+		provided[extension] = true
+	}
+	var missing []string
+	for _, library := range strings.Split(pg.Spec.PostgreSQL.Parameters["shared_preload_libraries"], ",") {
+		library = strings.Trim(strings.TrimSpace(library), `'"`)
+		if library != "" && !provided[library] {
+			missing = append(missing, library)
+		}
+	}
+	return missing
+}
+
+// applyImageSettings points every image of spec to the registry mirror configured for its
+// registry and adds the default image pull Secrets of the operator and those of the instance. It
+// can be applied more than once.
+func (r *PostgresReconciler) applyImageSettings(pg *postgresv1beta1.Postgres, spec *corev1.PodSpec) {
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].Image = rewriteImage(spec.InitContainers[i].Image, r.RegistryRewrites)
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Image = rewriteImage(spec.Containers[i].Image, r.RegistryRewrites)
+	}
+
+	seen := map[string]bool{}
+	for _, secret := range spec.ImagePullSecrets {
+		seen[secret.Name] = true
+	}
+	names := append([]string{}, r.ImagePullSecrets...)
+	for _, secret := range pg.Spec.ImagePullSecrets {
+		names = append(names, secret.Name)
+	}
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+}
+
+// rewriteImage replaces the registry of image by the mirror prefix rewrites maps it to. Images
+// without a registry are on docker.io, where official images live under library/.
+func rewriteImage(image string, rewrites map[string]string) string {
+	registry, path := "docker.io", image
+	if i := strings.IndexByte(image, '/'); i >= 0 {
+		if first := image[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			registry, path = first, image[i+1:]
+		}
+	}
+	prefix, ok := rewrites[registry]
+	if !ok {
+		return image
+	}
+	if registry == "docker.io" && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + path
+}
+
+// findPostgresForImageCatalog maps an ImageCatalog to the Postgres objects referencing it
+func (r *PostgresReconciler) findPostgresForImageCatalog(ctx context.Context, catalog client.Object) []reconcile.Request {
+	return r.findPostgresByFields(ctx, catalog, imageCatalogRefField)
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Image resolution", func() {
+	var (
+		pg       *postgresv1beta1.Postgres
+		catalog  *postgresv1beta1.ImageCatalog
+		recorder *record.FakeRecorder
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.PostgreSQL.Version = "16.2"
+		catalog = &postgresv1beta1.ImageCatalog{
+			ObjectMeta: metav1.ObjectMeta{Name: "postgis"},
+			Spec: postgresv1beta1.ImageCatalogSpec{Images: []postgresv1beta1.CatalogImage{
+				{Major: 15, Image: "postgis/postgis:15-3.4"},
+				{Major: 16, Image: "postgis/postgis:16-3.4", Extensions: []string{"postgis"}},
+			}},
+		}
+	})
+
+	var r *PostgresReconciler
+	resolve := func(version string) (string, error) {
+		if r == nil {
+			r = newTestReconciler(catalog, pg)
+			recorder = r.Recorder.(*record.FakeRecorder)
+		}
+		return r.resolveImage(context.Background(), pg, version)
+	}
+
+	AfterEach(func() {
+		r = nil
+	})
+
+	It("should default to the official image", func() {
+		Expect(resolve("16.2")).To(Equal("postgres:16.2"))
+	})
+
+	It("should take the image of the major version from the catalog", func() {
+		pg.Spec.ImageCatalogRef = &postgresv1beta1.ImageCatalogRef{Name: "postgis"}
+		Expect(resolve("16.2")).To(Equal("postgis/postgis:16-3.4"))
+		Expect(resolve("15")).To(Equal("postgis/postgis:15-3.4"))
+		_, err := resolve("17")
+		Expect(err).To(MatchError(ContainSubstring("no image for major version 17")))
+	})
+
+	It("should prefer the override for the spec version", func() {
+		pg.Spec.ImageCatalogRef = &postgresv1beta1.ImageCatalogRef{Name: "postgis"}
+		pg.Spec.Image = "registry.example.com/postgres@sha256:0123"
+		Expect(resolve("16.2")).To(Equal("registry.example.com/postgres@sha256:0123"))
+	})
+
+	It("should keep the running image until an upgrade reached the new version", func() {
+		pg.Spec.Image = "registry.example.com/postgres:16"
+		pg.Status.Version = "15"
+		pg.Status.Image = "registry.example.com/postgres:15"
+		Expect(resolve("15")).To(Equal("registry.example.com/postgres:15"))
+	})
+
+	It("should pull images through the configured mirrors", func() {
+		rewrites := map[string]string{"docker.io": "harbor.example.com/dockerhub/", "quay.io": "harbor.example.com/quay"}
+		Expect(rewriteImage("postgres:16", rewrites)).To(Equal("harbor.example.com/dockerhub/library/postgres:16"))
+		Expect(rewriteImage("tianon/postgres-upgrade:13-to-16", rewrites)).To(Equal("harbor.example.com/dockerhub/tianon/postgres-upgrade:13-to-16"))
+		Expect(rewriteImage("quay.io/prometheuscommunity/postgres-exporter:v0.15.0", rewrites)).
+			To(Equal("harbor.example.com/quay/prometheuscommunity/postgres-exporter:v0.15.0"))
+		Expect(rewriteImage("ghcr.io/cloudnative-pg/pgbouncer:1.23.0", rewrites)).To(Equal("ghcr.io/cloudnative-pg/pgbouncer:1.23.0"))
+		Expect(rewriteImage("harbor.example.com/dockerhub/library/postgres:16", rewrites)).To(Equal("harbor.example.com/dockerhub/library/postgres:16"))
+	})
+
+	It("should add the default pull Secrets before those of the instance", func() {
+		r := &PostgresReconciler{ImagePullSecrets: []string{"mirror"}}
+		pg.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "team"}, {Name: "mirror"}}
+		spec := &corev1.PodSpec{Containers: []corev1.Container{{Image: "postgres:16"}}}
+		r.applyImageSettings(pg, spec)
+		r.applyImageSettings(pg, spec)
+		Expect(spec.ImagePullSecrets).To(Equal([]corev1.LocalObjectReference{{Name: "mirror"}, {Name: "team"}}))
+		Expect(spec.Containers[0].Image).To(Equal("postgres:16"))
+	})
+
+	It("should warn about preloaded libraries the image does not provide", func() {
+		pg.Spec.ImageCatalogRef = &postgresv1beta1.ImageCatalogRef{Name: "postgis"}
+		pg.Spec.PostgreSQL.Parameters = map[string]string{"shared_preload_libraries": "'postgis, timescaledb'"}
+		Expect(resolve("16")).To(Equal("postgis/postgis:16-3.4"))
+		Expect(recorder.Events).To(Receive(ContainSubstring("timescaledb")))
+		Expect(meta.IsStatusConditionFalse(pg.Status.Conditions, postgresv1beta1.ConditionExtensions)).To(BeTrue())
+
+		By("not warning again while the same libraries are missing")
+		Expect(resolve("16")).To(Equal("postgis/postgis:16-3.4"))
+		Expect(recorder.Events).NotTo(Receive())
+
+		By("warning again once the missing libraries change")
+		pg.Spec.PostgreSQL.Parameters["shared_preload_libraries"] = "postgis,pg_cron"
+		Expect(resolve("16")).To(Equal("postgis/postgis:16-3.4"))
+		Expect(recorder.Events).To(Receive(ContainSubstring("pg_cron")))
+
+		By("clearing the condition once the image provides them")
+		pg.Spec.PostgreSQL.Parameters["shared_preload_libraries"] = "postgis"
+		Expect(resolve("16")).To(Equal("postgis/postgis:16-3.4"))
+		Expect(recorder.Events).NotTo(Receive())
+		Expect(meta.IsStatusConditionTrue(pg.Status.Conditions, postgresv1beta1.ConditionExtensions)).To(BeTrue())
+
+		var stored postgresv1beta1.Postgres
+		Expect(r.Get(context.Background(), client.ObjectKeyFromObject(pg), &stored)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(stored.Status.Conditions, postgresv1beta1.ConditionExtensions)).To(BeTrue())
+	})
+})
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// Reconcile steps used as the step label of reconcileErrors
+const (
+	stepSecret      = "secret"
+	stepTLS         = "tls"
+	stepMonitoring  = "monitoring"
+	stepConfig      = "config"
+	stepImage       = "image"
+	stepStatefulSet = "statefulset"
+	stepUpgrade     = "upgrade"
+	stepService     = "service"
+	stepDisruption  = "disruption"
+	stepNetwork     = "network"
+	stepPooler      = "pooler"
+	stepStatus      = "status"
+	stepDatabase    = "database"
+)
+
+var (
+	timeToReady = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "postgres_operator_time_to_ready_seconds",
+		Help:    "Time from creation of a Postgres object until the instance became ready for the first time.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+	})
+
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "postgres_operator_failovers_total",
+		Help: "Number of times the primary pod of an instance was replaced.",
+	}, []string{"namespace", "name"})
+
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "postgres_operator_reconcile_errors_total",
+		Help: "Number of reconcile errors by the step that failed.",
+	}, []string{"step"})
+
+	instancesDesc = prometheus.NewDesc(
+		"postgres_operator_instances",
+		"Number of Postgres instances by phase and version.",
+		[]string{"phase", "version"}, nil,
+	)
+
+	lastBackupDesc = prometheus.NewDesc(
+		"postgres_operator_last_successful_backup_timestamp_seconds",
+		"Completion time of the latest successful backup of an instance.",
+		[]string{"namespace", "name"}, nil,
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(timeToReady, failovers, reconcileErrors)
+}
+
+// instanceCollector reports the state of all Postgres objects at scrape time, so the values stay
+// correct across operator restarts and for objects that are not being reconciled.
+type instanceCollector struct {
+	reader client.Reader
+}
+
+func (c *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+	ch <- lastBackupDesc
+}
+
+func (c *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var postgresList postgresv1beta1.PostgresList
+	if err := c.reader.List(ctx, &postgresList); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list Postgres for metrics")
+		return
+	}
+
+	type key struct{ phase, version string }
+	counts := map[key]int{}
+	for _, pg := range postgresList.Items {
+		phase := pg.Status.Phase
+		if phase == "" {
+			phase = postgresv1beta1.PostgresPhaseCreating
+		}
+		counts[key{string(phase), pg.Spec.PostgreSQL.Version}]++
+
+		if pg.Status.LastSuccessfulBackup != nil {
+			ch <- prometheus.MustNewConstMetric(lastBackupDesc, prometheus.GaugeValue,
+				float64(pg.Status.LastSuccessfulBackup.Unix()), pg.Namespace, pg.Name)
+		}
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(n), k.phase, k.version)
+	}
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Operator metrics", func() {
+	It("should count the instances by phase and version", func() {
+		running := newTestPostgres()
+		running.Spec.PostgreSQL.Version = "16"
+		running.Status.Phase = postgresv1beta1.PostgresPhaseReady
+		billing := running.DeepCopy()
+		billing.ObjectMeta = metav1.ObjectMeta{Name: "billing", Namespace: "shop"}
+		creating := newTestPostgres()
+		creating.ObjectMeta = metav1.ObjectMeta{Name: "inventory", Namespace: "shop"}
+		creating.Spec.PostgreSQL.Version = "15"
+
+		collector := &instanceCollector{reader: newTestReconciler(running, billing, creating).Client}
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP postgres_operator_instances Number of Postgres instances by phase and version.
+# TYPE postgres_operator_instances gauge
+postgres_operator_instances{phase="Creating",version="15"} 1
+postgres_operator_instances{phase="Ready",version="16"} 2
+`))).To(Succeed())
+	})
+
+	It("should report the latest backup of the instances that have one", func() {
+		backedUp := newTestPostgres()
+		backedUp.Status.LastSuccessfulBackup = &metav1.Time{Time: time.Unix(1700000000, 0)}
+		other := newTestPostgres()
+		other.ObjectMeta = metav1.ObjectMeta{Name: "billing", Namespace: "shop"}
+
+		collector := &instanceCollector{reader: newTestReconciler(backedUp, other).Client}
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP postgres_operator_last_successful_backup_timestamp_seconds Completion time of the latest successful backup of an instance.
+# TYPE postgres_operator_last_successful_backup_timestamp_seconds gauge
+postgres_operator_last_successful_backup_timestamp_seconds{name="orders",namespace="shop"} 1.7e+09
+`), "postgres_operator_last_successful_backup_timestamp_seconds")).To(Succeed())
+	})
+
+	It("should forget the failovers of a deleted instance", func() {
+		pg := newTestPostgres()
+		pg.Spec.Deletion.Policy = postgresv1beta1.DeletionPolicyRetain
+		failovers.WithLabelValues("shop", "orders").Inc()
+		Expect(testutil.ToFloat64(failovers.WithLabelValues("shop", "orders"))).To(Equal(1.0))
+
+		requeueAfter, err := newTestReconciler(pg).finalizerPostgres(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+		Expect(testutil.CollectAndCount(failovers)).To(BeZero())
+	})
+})
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	defaultExporterImage = "quay.io/prometheuscommunity/postgres-exporter:v0.15.0"
+
+	// monitoringUser is the least privileged role the exporter connects as
+	monitoringUser = "postgres_exporter"
+
+	exporterPort             = 9187
+	exporterSecretMountPath  = "/etc/postgres-exporter/credentials"
+	monitoringPasswordSecret = "password"
+)
+
+var serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+func monitoringEnabled(pg *postgresv1beta1.Postgres) bool {
+	return pg.Spec.Monitoring != nil && pg.Spec.Monitoring.Enabled
+}
+
+func monitoringSecretName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-monitoring"
+}
+
+// reconcileMonitoringSecret keeps the generated password of the monitoring role, or removes it
+// when monitoring is disabled.
+func (r *PostgresReconciler) reconcileMonitoringSecret(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	secret := &corev1.Secret{ObjectMeta: ctrl.ObjectMeta{Name: monitoringSecretName(pg), Namespace: pg.Namespace}}
+	if !monitoringEnabled(pg) {
+		return r.deleteOwned(ctx, pg, secret)
+	}
+	return r.reconcileOwned(ctx, pg, secret, func() error {
+		secret.Labels = map[string]string{"app": pg.Name}
+		if len(secret.Data[monitoringPasswordSecret]) > 0 {
+			return nil
+		}
+		password, err := generatePassword()
+		if err != nil {
+			return err
+		}
+		secret.Data = map[string][]byte{monitoringPasswordSecret: []byte(password)}
+		return nil
+	})
+}
+
+// exporterContainers returns the postgres_exporter sidecars scraping the local server. The first
+// one serves the default metrics and the custom queries of the instance database, every other
+// database with custom queries gets its own container serving only those.
+func exporterContainers(pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) []corev1.Container {
+	image := defaultExporterImage
+	if pg.Spec.Monitoring.Image != "" {
+		image = pg.Spec.Monitoring.Image
+	}
+
+	var containers []corev1.Container
+	for i, db := range exporterDatabases(pg, queries) {
+		port := int32(exporterPort + i)
+		name := "exporter"
+		args := []string{fmt.Sprintf("--web.listen-address=:%d", port)}
+		if i > 0 {
+			name = fmt.Sprintf("exporter-%d", i)
+			args = append(args, "--disable-default-metrics", "--disable-settings-metrics")
+		}
+		mounts := []corev1.VolumeMount{{
+			Name:      "monitoring",
+			MountPath: exporterSecretMountPath,
+			ReadOnly:  true,
+		}}
+		if queries != nil && queries.Data[db+".yaml"] != "" {
+			args = append(args, "--extend.query-path="+exporterQueriesMountPath+"/"+db+".yaml")
+			mounts = append(mounts, corev1.VolumeMount{
+				Name:      "monitoring-queries",
+				MountPath: exporterQueriesMountPath,
+				ReadOnly:  true,
+			})
+		}
+
+		containers = append(containers, corev1.Container{
+			Name:  name,
+			Image: image,
+			Args:  args,
+			Ports: []corev1.ContainerPort{{
+				ContainerPort: port,
+				Name:          exporterPortName(i),
+			}},
+			Env: []corev1.EnvVar{
+				{Name: "DATA_SOURCE_URI", Value: "localhost:5432/" + db + "?sslmode=disable"},
+				{Name: "DATA_SOURCE_USER", Value: monitoringUser},
+				{Name: "DATA_SOURCE_PASS_FILE", Value: exporterSecretMountPath + "/" + monitoringPasswordSecret},
+			},
+			ReadinessProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					HTTPGet: &corev1.HTTPGetAction{Path: "/", Port: intstr.FromString(exporterPortName(i))},
+				},
+			},
+			VolumeMounts: mounts,
+		})
+	}
+	return containers
+}
+
+// reconcileServiceMonitor creates a ServiceMonitor for the instance when the Prometheus Operator
+// CRDs are installed, and removes it again when monitoring is disabled.
+func (r *PostgresReconciler) reconcileServiceMonitor(ctx context.Context, pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) error {
+	if _, err := r.RESTMapper().RESTMapping(serviceMonitorGVK.GroupKind(), serviceMonitorGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil
+		}
+		return err
+	}
+
+	serviceMonitor := &unstructured.Unstructured{}
+	serviceMonitor.SetGroupVersionKind(serviceMonitorGVK)
+	serviceMonitor.SetName(pg.Name)
+	serviceMonitor.SetNamespace(pg.Namespace)
+	if !monitoringEnabled(pg) {
+		return r.deleteOwned(ctx, pg, serviceMonitor)
+	}
+
+	var endpoints []interface{}
+	for i := range exporterDatabases(pg, queries) {
+		endpoints = append(endpoints, map[string]interface{}{"port": exporterPortName(i), "interval": "30s"})
+	}
+
+	return r.reconcileOwned(ctx, pg, serviceMonitor, func() error {
+		serviceMonitor.SetLabels(map[string]string{"app": pg.Name})
+		return unstructured.SetNestedField(serviceMonitor.Object, map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": pg.Name},
+			},
+			"namespaceSelector": map[string]interface{}{
+				"matchNames": []interface{}{pg.Namespace},
+			},
+			"endpoints": endpoints,
+		}, "spec")
+	})
+}
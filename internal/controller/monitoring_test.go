@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Monitoring", func() {
+	var pg *postgresv1beta1.Postgres
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Auth.Database = "orders"
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{Enabled: true}
+	})
+
+	queries := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-monitoring-queries", Namespace: "shop"},
+		Data:       map[string]string{"orders.yaml": "pg_orders: {}", "reports.yaml": "pg_reports: {}"},
+	}
+
+	It("should scrape the instance database as the monitoring role", func() {
+		containers := exporterContainers(pg, nil)
+		Expect(containers).To(HaveLen(1))
+		exporter := containers[0]
+		Expect(exporter.Name).To(Equal("exporter"))
+		Expect(exporter.Image).To(Equal(defaultExporterImage))
+		Expect(exporter.Args).To(Equal([]string{"--web.listen-address=:9187"}))
+		Expect(exporter.Ports).To(Equal([]corev1.ContainerPort{{ContainerPort: exporterPort, Name: "metrics"}}))
+		Expect(exporter.Env).To(Equal([]corev1.EnvVar{
+			{Name: "DATA_SOURCE_URI", Value: "localhost:5432/orders?sslmode=disable"},
+			{Name: "DATA_SOURCE_USER", Value: "postgres_exporter"},
+			{Name: "DATA_SOURCE_PASS_FILE", Value: exporterSecretMountPath + "/password"},
+		}))
+		Expect(exporter.VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "monitoring", MountPath: exporterSecretMountPath, ReadOnly: true}}))
+		Expect(exporter.ReadinessProbe.HTTPGet.Port).To(Equal(intstr.FromString("metrics")))
+
+		pg.Spec.Monitoring.Image = "registry.example.com/postgres-exporter:v0.15.0"
+		Expect(exporterContainers(pg, nil)[0].Image).To(Equal("registry.example.com/postgres-exporter:v0.15.0"))
+	})
+
+	It("should add an exporter per database with custom queries", func() {
+		containers := exporterContainers(pg, queries)
+		Expect(containers).To(HaveLen(2))
+		Expect(containers[0].Args).To(ConsistOf("--web.listen-address=:9187", "--extend.query-path="+exporterQueriesMountPath+"/orders.yaml"))
+
+		reports := containers[1]
+		Expect(reports.Name).To(Equal("exporter-1"))
+		Expect(reports.Args).To(ConsistOf("--web.listen-address=:9188", "--disable-default-metrics", "--disable-settings-metrics",
+			"--extend.query-path="+exporterQueriesMountPath+"/reports.yaml"))
+		Expect(reports.Ports[0].Name).To(Equal("metrics-1"))
+		Expect(reports.Env[0].Value).To(Equal("localhost:5432/reports?sslmode=disable"))
+		Expect(reports.VolumeMounts).To(ContainElement(HaveField("Name", "monitoring-queries")))
+	})
+
+	It("should inject the exporters into the pods and expose their ports on the Service", func() {
+		pg.SetDefaults()
+		r := &PostgresReconciler{}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: pg.Spec.Auth.SecretRef, Namespace: "shop"}}
+		spec := r.statefulSetForPostgres(pg, secret, r.configMapForPostgres(pg), nil, queries, "postgres:16").Spec.Template.Spec
+		Expect(spec.Containers).To(HaveLen(3))
+		Expect(spec.Containers[1].Name).To(Equal("exporter"))
+		Expect(spec.Containers[2].Name).To(Equal("exporter-1"))
+		Expect(spec.Volumes).To(ContainElement(HaveField("Secret.SecretName", "orders-monitoring")))
+
+		ports := r.serviceForPostgres(pg, queries).Spec.Ports
+		Expect(ports).To(HaveLen(3))
+		Expect(ports[1].Name).To(Equal("metrics"))
+		Expect(ports[2].Port).To(Equal(int32(9188)))
+
+		By("leaving them out when monitoring is disabled")
+		pg.Spec.Monitoring.Enabled = false
+		Expect(r.statefulSetForPostgres(pg, secret, r.configMapForPostgres(pg), nil, queries, "postgres:16").Spec.Template.Spec.Containers).To(HaveLen(1))
+		Expect(r.serviceForPostgres(pg, queries).Spec.Ports).To(HaveLen(1))
+	})
+
+	It("should keep the password of the monitoring role until monitoring is disabled", func() {
+		r := newTestReconciler(pg)
+		Expect(r.reconcileMonitoringSecret(context.Background(), pg)).To(Succeed())
+		var secret corev1.Secret
+		key := client.ObjectKey{Name: "orders-monitoring", Namespace: "shop"}
+		Expect(r.Get(context.Background(), key, &secret)).To(Succeed())
+		password := secret.Data["password"]
+		Expect(password).NotTo(BeEmpty())
+
+		Expect(r.reconcileMonitoringSecret(context.Background(), pg)).To(Succeed())
+		Expect(r.Get(context.Background(), key, &secret)).To(Succeed())
+		Expect(secret.Data["password"]).To(Equal(password))
+
+		pg.Spec.Monitoring.Enabled = false
+		Expect(r.reconcileMonitoringSecret(context.Background(), pg)).To(Succeed())
+		Expect(apierrors.IsNotFound(r.Get(context.Background(), key, &secret))).To(BeTrue())
+	})
+
+	Context("ServiceMonitor", func() {
+		// reconciler serves ServiceMonitors like a cluster with the Prometheus Operator CRDs installed
+		reconciler := func() *PostgresReconciler {
+			r := newTestReconciler()
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(serviceMonitorGVK, meta.RESTScopeNamespace)
+			r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).WithObjects(pg).Build()
+			return r
+		}
+
+		getServiceMonitor := func(r *PostgresReconciler) (*unstructured.Unstructured, error) {
+			serviceMonitor := &unstructured.Unstructured{}
+			serviceMonitor.SetGroupVersionKind(serviceMonitorGVK)
+			err := r.Get(context.Background(), client.ObjectKey{Name: "orders", Namespace: "shop"}, serviceMonitor)
+			return serviceMonitor, err
+		}
+
+		It("should scrape every exporter port of the instance", func() {
+			r := reconciler()
+			Expect(r.reconcileServiceMonitor(context.Background(), pg, queries)).To(Succeed())
+			serviceMonitor, err := getServiceMonitor(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metav1.IsControlledBy(serviceMonitor, pg)).To(BeTrue())
+
+			selector, _, err := unstructured.NestedStringMap(serviceMonitor.Object, "spec", "selector", "matchLabels")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(selector).To(Equal(map[string]string{"app": "orders"}))
+			namespaces, _, err := unstructured.NestedStringSlice(serviceMonitor.Object, "spec", "namespaceSelector", "matchNames")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespaces).To(Equal([]string{"shop"}))
+			endpoints, _, err := unstructured.NestedSlice(serviceMonitor.Object, "spec", "endpoints")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(endpoints).To(Equal([]interface{}{
+				map[string]interface{}{"port": "metrics", "interval": "30s"},
+				map[string]interface{}{"port": "metrics-1", "interval": "30s"},
+			}))
+
+			By("removing it when monitoring is disabled")
+			pg.Spec.Monitoring.Enabled = false
+			Expect(r.reconcileServiceMonitor(context.Background(), pg, queries)).To(Succeed())
+			_, err = getServiceMonitor(r)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should skip it without the Prometheus Operator CRDs", func() {
+			r := newTestReconciler(pg)
+			Expect(r.reconcileServiceMonitor(context.Background(), pg, queries)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+
+// operatorPodLabels are the labels of the operator pods in config/manager
+var operatorPodLabels = map[string]string{"control-plane": "controller-manager"}
+
+// reconcileNetworkPolicy keeps the NetworkPolicy of spec.networkPolicy, and removes it again
+// when the field is unset
+func (r *PostgresReconciler) reconcileNetworkPolicy(ctx context.Context, pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) error {
+	policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: pg.Name, Namespace: pg.Namespace}}
+	if pg.Spec.NetworkPolicy == nil {
+		return r.deleteOwned(ctx, pg, policy)
+	}
+	return r.reconcileOwned(ctx, pg, policy, func() error {
+		policy.Labels = map[string]string{"app": pg.Name}
+		policy.Spec = r.networkPolicySpec(pg, queries)
+		return nil
+	})
+}
+
+// networkPolicySpec covers the pods of the instance, of a blue/green upgrade and of the pooler.
+// Postgres and PgBouncer both listen on 5432, which the clients, the operator and these pods
+// themselves may connect to, e.g. the pooler or a new version replicating from the instance.
+// The exporter ports are open to spec.networkPolicy.scrapers, by default the Prometheus namespace.
+func (r *PostgresReconciler) networkPolicySpec(pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) networkingv1.NetworkPolicySpec {
+	postgresPort := intstr.FromInt32(5432)
+	tcp := corev1.ProtocolTCP
+
+	operatorNamespaces := &metav1.LabelSelector{}
+	if r.OperatorNamespace != "" {
+		operatorNamespaces.MatchLabels = map[string]string{corev1.LabelMetadataName: r.OperatorNamespace}
+	}
+	peers := []networkingv1.NetworkPolicyPeer{
+		{
+			NamespaceSelector: operatorNamespaces,
+			PodSelector:       &metav1.LabelSelector{MatchLabels: operatorPodLabels},
+		},
+		{
+			PodSelector: appSelector(pg.Name, greenName(pg), poolerName(pg), schemaJobName(pg)),
+		},
+	}
+	peers = append(peers, policyPeers(pg.Spec.NetworkPolicy.Clients)...)
+
+	spec := networkingv1.NetworkPolicySpec{
+		PodSelector: *appSelector(pg.Name, greenName(pg), poolerName(pg)),
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &postgresPort}},
+			From:  peers,
+		}},
+	}
+
+	scrapers := policyPeers(pg.Spec.NetworkPolicy.Scrapers)
+	if len(scrapers) == 0 && r.PrometheusNamespace != "" {
+		scrapers = []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{corev1.LabelMetadataName: r.PrometheusNamespace},
+		}}}
+	}
+	// A rule without peers would let anyone scrape
+	if monitoringEnabled(pg) && len(scrapers) > 0 {
+		var ports []networkingv1.NetworkPolicyPort
+		for i := range exporterDatabases(pg, queries) {
+			port := intstr.FromInt32(int32(exporterPort + i))
+			ports = append(ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+		}
+		spec.Ingress = append(spec.Ingress, networkingv1.NetworkPolicyIngressRule{Ports: ports, From: scrapers})
+	}
+	return spec
+}
+
+// policyPeers returns the NetworkPolicy peers selecting clients
+func policyPeers(clients []postgresv1beta1.NetworkPolicyClient) []networkingv1.NetworkPolicyPeer {
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, client := range clients {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: client.NamespaceSelector.DeepCopy(),
+			PodSelector:       client.PodSelector.DeepCopy(),
+		})
+	}
+	return peers
+}
+
+// appSelector selects the pods whose app label is one of apps
+func appSelector(apps ...string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key:      "app",
+		Operator: metav1.LabelSelectorOpIn,
+		Values:   apps,
+	}}}
+}
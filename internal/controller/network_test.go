@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Network policy", func() {
+	var (
+		pg *postgresv1beta1.Postgres
+		r  *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Auth.Database = "orders"
+		pg.Spec.NetworkPolicy = &postgresv1beta1.NetworkPolicy{Clients: []postgresv1beta1.NetworkPolicyClient{{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "checkout"}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+		}}}
+		r = newTestReconciler(pg)
+		r.OperatorNamespace = "postgresql-operator-system"
+	})
+
+	getPolicy := func() (*networkingv1.NetworkPolicy, error) {
+		var policy networkingv1.NetworkPolicy
+		err := r.Get(context.Background(), types.NamespacedName{Name: "orders", Namespace: "shop"}, &policy)
+		return &policy, err
+	}
+
+	It("should only let the clients, the operator and the instance itself connect", func() {
+		Expect(r.reconcileNetworkPolicy(context.Background(), pg, nil)).To(Succeed())
+		policy, err := getPolicy()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Spec.PodSelector.MatchExpressions[0].Values).To(ConsistOf("orders", "orders-green", "orders-pooler"))
+		Expect(policy.Spec.Ingress).To(HaveLen(1))
+
+		rule := policy.Spec.Ingress[0]
+		Expect(*rule.Ports[0].Port).To(Equal(intstr.FromInt32(5432)))
+		Expect(rule.From).To(HaveLen(3))
+		Expect(rule.From[0].NamespaceSelector.MatchLabels).To(Equal(map[string]string{corev1.LabelMetadataName: "postgresql-operator-system"}))
+		Expect(rule.From[1].PodSelector.MatchExpressions[0].Values).To(ContainElement("orders-schema"))
+		Expect(rule.From[2].NamespaceSelector.MatchLabels).To(Equal(map[string]string{"team": "checkout"}))
+	})
+
+	It("should open the exporter ports to the Prometheus namespace by default", func() {
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{Enabled: true}
+		r.PrometheusNamespace = "monitoring"
+		spec := r.networkPolicySpec(pg, nil)
+		Expect(spec.Ingress).To(HaveLen(2))
+		Expect(*spec.Ingress[1].Ports[0].Port).To(Equal(intstr.FromInt32(exporterPort)))
+		Expect(spec.Ingress[1].From).To(HaveLen(1))
+		Expect(spec.Ingress[1].From[0].NamespaceSelector.MatchLabels).To(Equal(map[string]string{corev1.LabelMetadataName: "monitoring"}))
+		Expect(spec.Ingress[1].From[0].PodSelector).To(BeNil())
+	})
+
+	It("should open the exporter ports to the configured scrapers", func() {
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{Enabled: true}
+		pg.Spec.NetworkPolicy.Scrapers = []postgresv1beta1.NetworkPolicyClient{{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "observability"}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "prometheus"}},
+		}}
+		r.PrometheusNamespace = "monitoring"
+		spec := r.networkPolicySpec(pg, nil)
+		Expect(spec.Ingress).To(HaveLen(2))
+		Expect(spec.Ingress[1].From).To(HaveLen(1))
+		Expect(spec.Ingress[1].From[0].NamespaceSelector.MatchLabels).To(Equal(map[string]string{"team": "observability"}))
+		Expect(spec.Ingress[1].From[0].PodSelector.MatchLabels).To(Equal(map[string]string{"app": "prometheus"}))
+	})
+
+	It("should keep the exporter ports closed without scrapers", func() {
+		pg.Spec.Monitoring = &postgresv1beta1.Monitoring{Enabled: true}
+		r.PrometheusNamespace = ""
+		spec := r.networkPolicySpec(pg, nil)
+		Expect(spec.Ingress).To(HaveLen(1))
+	})
+
+	It("should remove the policy when it is disabled", func() {
+		Expect(r.reconcileNetworkPolicy(context.Background(), pg, nil)).To(Succeed())
+		pg.Spec.NetworkPolicy = nil
+		Expect(r.reconcileNetworkPolicy(context.Background(), pg, nil)).To(Succeed())
+		_, err := getPolicy()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
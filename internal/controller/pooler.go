@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	defaultPoolerImage = "ghcr.io/cloudnative-pg/pgbouncer:1.23.0"
+
+	// poolerAuthUser is the role PgBouncer uses to look up client passwords through auth_query
+	poolerAuthUser = "pgbouncer_auth"
+
+	poolerConfigMountPath   = "/etc/pgbouncer/config"
+	poolerUserlistMountPath = "/etc/pgbouncer/userlist"
+)
+
+func poolerName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-pooler"
+}
+
+func poolerEnabled(pg *postgresv1beta1.Postgres) bool {
+	return pg.Spec.Pooler != nil && pg.Spec.Pooler.Enabled
+}
+
+// reconcilePooler creates or updates the PgBouncer Deployment and Service in front of the
+// instance, or removes them when the pooler is disabled.
+func (r *PostgresReconciler) reconcilePooler(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	meta := ctrl.ObjectMeta{Name: poolerName(pg), Namespace: pg.Namespace}
+	if !poolerEnabled(pg) {
+		for _, obj := range []client.Object{
+			&appsv1.Deployment{ObjectMeta: meta},
+			&corev1.Service{ObjectMeta: meta},
+			&corev1.ConfigMap{ObjectMeta: meta},
+			&corev1.Secret{ObjectMeta: meta},
+		} {
+			if err := r.deleteOwned(ctx, pg, obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	labels := map[string]string{"app": poolerName(pg)}
+
+	// The auth user password is generated once and kept stable afterwards
+	secret := &corev1.Secret{ObjectMeta: meta}
+	if err := r.reconcileOwned(ctx, pg, secret, func() error {
+		secret.Labels = labels
+		password := string(secret.Data["password"])
+		if password == "" {
+			generated, err := generatePassword()
+			if err != nil {
+				return err
+			}
+			password = generated
+		}
+		secret.Data = map[string][]byte{
+			"password":     []byte(password),
+			"userlist.txt": []byte(fmt.Sprintf("%q %q\n", poolerAuthUser, password)),
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: meta}
+	if err := r.reconcileOwned(ctx, pg, configMap, func() error {
+		configMap.Labels = labels
+		configMap.Data = map[string]string{"pgbouncer.ini": pgbouncerIni(pg)}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: meta}
+	if err := r.reconcileOwned(ctx, pg, deployment, func() error {
+		desired := r.deploymentForPooler(pg, configMap, secret)
+		deployment.Labels = labels
+		deployment.Spec.Replicas = desired.Spec.Replicas
+		if deployment.Annotations[templateHashAnnotation] != desired.Annotations[templateHashAnnotation] {
+			deployment.Annotations = desired.Annotations
+			deployment.Spec.Selector = desired.Spec.Selector
+			deployment.Spec.Template = desired.Spec.Template
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	service := &corev1.Service{ObjectMeta: meta}
+	return r.reconcileOwned(ctx, pg, service, func() error {
+		service.Labels = labels
+		service.Spec.Selector = labels
+		service.Spec.Type = corev1.ServiceTypeClusterIP
+		service.Spec.Ports = []corev1.ServicePort{{
+			Port:       5432,
+			Name:       "pgbouncer",
+			Protocol:   corev1.ProtocolTCP,
+			TargetPort: intstr.FromString("pgbouncer"),
+		}}
+		return nil
+	})
+}
+
+// pgbouncerIni renders the PgBouncer configuration. Every database is forwarded to the read-write
+// Service and client passwords are looked up in the server through the auth user.
+func pgbouncerIni(pg *postgresv1beta1.Postgres) string {
+	pooler := pg.Spec.Pooler
+	poolMode := pooler.PoolMode
+	if poolMode == "" {
+		poolMode = postgresv1beta1.PoolModeTransaction
+	}
+	defaultPoolSize := pooler.DefaultPoolSize
+	if defaultPoolSize == 0 {
+		defaultPoolSize = 20
+	}
+	maxClientConn := pooler.MaxClientConn
+	if maxClientConn == 0 {
+		maxClientConn = 1000
+	}
+
+	lines := []string{
+		"[databases]",
+		fmt.Sprintf("* = host=%s.%s.svc port=5432", serviceName(pg), pg.Namespace),
+		"",
+		"[pgbouncer]",
+		"listen_addr = 0.0.0.0",
+		"listen_port = 5432",
+		"unix_socket_dir =",
+		"auth_type = md5",
+		"auth_file = " + poolerUserlistMountPath + "/userlist.txt",
+		"auth_user = " + poolerAuthUser,
+		"auth_dbname = postgres",
+		"auth_query = SELECT usename, passwd FROM pgbouncer.get_auth($1)",
+		"pool_mode = " + string(poolMode),
+		fmt.Sprintf("default_pool_size = %d", defaultPoolSize),
+		fmt.Sprintf("max_client_conn = %d", maxClientConn),
+		"ignore_startup_parameters = extra_float_digits",
+	}
+	if pg.Spec.TLS != nil {
+		lines = append(lines, "server_tls_sslmode = require")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Helper function deploymentForPooler returns the PgBouncer Deployment
+func (r *PostgresReconciler) deploymentForPooler(pg *postgresv1beta1.Postgres, configMap *corev1.ConfigMap, secret *corev1.Secret) *appsv1.Deployment {
+	labels := map[string]string{"app": poolerName(pg)}
+	replicas := int32(1)
+	if pg.Spec.Pooler.Replicas != nil {
+		replicas = *pg.Spec.Pooler.Replicas
+	}
+	image := defaultPoolerImage
+	if pg.Spec.Pooler.Image != "" {
+		image = pg.Spec.Pooler.Image
+	}
+	userlistMode := int32(0444)
+
+	probe := &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("pgbouncer")},
+		},
+		PeriodSeconds: 10,
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      poolerName(pg),
+			Namespace: pg.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						configHashAnnotation: hashObject(configMap.Data),
+						secretHashAnnotation: secretHash(secret, "userlist.txt"),
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:    "pgbouncer",
+						Image:   image,
+						Command: []string{"pgbouncer", poolerConfigMountPath + "/pgbouncer.ini"},
+						Ports: []corev1.ContainerPort{{
+							ContainerPort: 5432,
+							Name:          "pgbouncer",
+						}},
+						ReadinessProbe: probe,
+						LivenessProbe:  probe,
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "config",
+								MountPath: poolerConfigMountPath,
+								ReadOnly:  true,
+							},
+							{
+								Name:      "userlist",
+								MountPath: poolerUserlistMountPath,
+								ReadOnly:  true,
+							},
+						},
+					}},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name},
+								},
+							},
+						},
+						{
+							Name: "userlist",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: secret.Name,
+									Items: []corev1.KeyToPath{
+										{Key: "userlist.txt", Path: "userlist.txt"},
+									},
+									DefaultMode: &userlistMode,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	applyNodePlacement(pg, &deployment.Spec.Template.Spec)
+	applyPodSecurity(pg, &deployment.Spec.Template.Spec)
+	r.applyImageSettings(pg, &deployment.Spec.Template.Spec)
+
+	deployment.Annotations = map[string]string{
+		templateHashAnnotation: hashObject(deployment.Spec.Template),
+	}
+	return deployment
+}
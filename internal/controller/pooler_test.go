@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Pooler", func() {
+	var (
+		pg *postgresv1beta1.Postgres
+		r  *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Pooler = &postgresv1beta1.Pooler{Enabled: true}
+		r = newTestReconciler(pg)
+	})
+
+	pooler := types.NamespacedName{Name: "orders-pooler", Namespace: "shop"}
+
+	It("should forward to the instance and look up client passwords with auth_query", func() {
+		ini := pgbouncerIni(pg)
+		Expect(ini).To(HavePrefix("[databases]\n* = host=orders.shop.svc port=5432\n"))
+		Expect(strings.Split(ini, "\n")).To(ContainElements(
+			"auth_type = md5",
+			"auth_file = "+poolerUserlistMountPath+"/userlist.txt",
+			"auth_user = pgbouncer_auth",
+			"auth_dbname = postgres",
+			"auth_query = SELECT usename, passwd FROM pgbouncer.get_auth($1)",
+			"pool_mode = transaction",
+			"default_pool_size = 20",
+			"max_client_conn = 1000",
+		))
+		Expect(ini).NotTo(ContainSubstring("server_tls_sslmode"))
+	})
+
+	It("should apply the pool settings of the spec", func() {
+		pg.Spec.Pooler.PoolMode = postgresv1beta1.PoolModeSession
+		pg.Spec.Pooler.DefaultPoolSize = 50
+		pg.Spec.Pooler.MaxClientConn = 5000
+		pg.Spec.TLS = &postgresv1beta1.TLS{Mode: postgresv1beta1.TLSModeOperator}
+		Expect(strings.Split(pgbouncerIni(pg), "\n")).To(ContainElements(
+			"pool_mode = session",
+			"default_pool_size = 50",
+			"max_client_conn = 5000",
+			"server_tls_sslmode = require",
+		))
+	})
+
+	It("should generate the auth user password once and list it in the userlist", func() {
+		replicas := int32(3)
+		pg.Spec.Pooler.Replicas = &replicas
+		Expect(r.reconcilePooler(context.Background(), pg)).To(Succeed())
+
+		var secret corev1.Secret
+		Expect(r.Get(context.Background(), pooler, &secret)).To(Succeed())
+		password := string(secret.Data["password"])
+		Expect(password).NotTo(BeEmpty())
+		Expect(string(secret.Data["userlist.txt"])).To(Equal(`"pgbouncer_auth" "` + password + "\"\n"))
+
+		var configMap corev1.ConfigMap
+		Expect(r.Get(context.Background(), pooler, &configMap)).To(Succeed())
+		Expect(configMap.Data).To(HaveKeyWithValue("pgbouncer.ini", pgbouncerIni(pg)))
+
+		var deployment appsv1.Deployment
+		Expect(r.Get(context.Background(), pooler, &deployment)).To(Succeed())
+		Expect(*deployment.Spec.Replicas).To(Equal(int32(3)))
+		Expect(deployment.Spec.Template.Spec.Containers[0].Image).To(Equal(defaultPoolerImage))
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue(secretHashAnnotation, secretHash(&secret, "userlist.txt")))
+
+		By("keeping the password on the next reconcile")
+		Expect(r.reconcilePooler(context.Background(), pg)).To(Succeed())
+		Expect(r.Get(context.Background(), pooler, &secret)).To(Succeed())
+		Expect(string(secret.Data["password"])).To(Equal(password))
+	})
+
+	It("should run the pooler on the nodes of the instance", func() {
+		nodeAffinity := &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{{
+				Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"a"},
+			}}}},
+		}}
+		pg.Spec.Scheduling = &postgresv1beta1.Scheduling{
+			NodeSelector:      map[string]string{"pool": "databases"},
+			Tolerations:       []corev1.Toleration{{Key: "dedicated", Value: "databases", Effect: corev1.TaintEffectNoSchedule}},
+			PriorityClassName: "databases",
+			Affinity: &corev1.Affinity{
+				NodeAffinity:    nodeAffinity,
+				PodAntiAffinity: &corev1.PodAntiAffinity{},
+			},
+			TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: corev1.LabelTopologyZone}},
+		}
+		Expect(r.reconcilePooler(context.Background(), pg)).To(Succeed())
+
+		var deployment appsv1.Deployment
+		Expect(r.Get(context.Background(), pooler, &deployment)).To(Succeed())
+		spec := deployment.Spec.Template.Spec
+		Expect(spec.NodeSelector).To(Equal(map[string]string{"pool": "databases"}))
+		Expect(spec.Tolerations).To(Equal(pg.Spec.Scheduling.Tolerations))
+		Expect(spec.PriorityClassName).To(Equal("databases"))
+		Expect(spec.Affinity).To(Equal(&corev1.Affinity{NodeAffinity: nodeAffinity}))
+		Expect(spec.TopologySpreadConstraints).To(BeEmpty())
+	})
+
+	It("should remove the pooler when it is disabled", func() {
+		Expect(r.reconcilePooler(context.Background(), pg)).To(Succeed())
+		pg.Spec.Pooler.Enabled = false
+		Expect(r.reconcilePooler(context.Background(), pg)).To(Succeed())
+		for _, obj := range []client.Object{&appsv1.Deployment{}, &corev1.Service{}, &corev1.ConfigMap{}, &corev1.Secret{}} {
+			Expect(apierrors.IsNotFound(r.Get(context.Background(), pooler, obj))).To(BeTrue())
+		}
+	})
+})
@@ -2,41 +2,111 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
-	postgresv1alpha1 "github.com/rezacloner1372/postgresql-operator/api/v1alpha1"
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
 )
 
+const (
+	// secretRefField is the field index used to look up Postgres objects by their credentials Secret
+	secretRefField = ".spec.auth.secretRef"
+
+	// tlsSecretRefField is the field index used to look up Postgres objects by their certificate Secret
+	tlsSecretRefField = ".spec.tls.secretRef"
+
+	// templateHashAnnotation holds a hash of the pod template last applied to the StatefulSet
+	templateHashAnnotation = "postgres.snappcloud.io/template-hash"
+
+	// secretHashAnnotation holds a hash of the credentials the pods were started with
+	secretHashAnnotation = "postgres.snappcloud.io/secret-hash"
+
+	// credentialsMountPath is where the credentials Secret is mounted as files
+	credentialsMountPath = "/etc/postgresql/credentials"
+
+	// legacyServiceName is the Service all instances of a namespace shared before each instance got
+	// its own. Instances that still own it keep it until the LegacyServiceAnnotation removes it.
+	legacyServiceName = "postgres-service"
+)
+
+// serviceName returns the name of the Service clients reach the instance through
+func serviceName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name
+}
+
 // PostgresReconciler reconciles a Postgres object
 type PostgresReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// RegistryRewrites maps registries to the mirror prefixes their images are pulled from instead,
+	// e.g. docker.io to harbor.example.com/dockerhub
+	RegistryRewrites map[string]string
+	// ImagePullSecrets are added to every pod the operator creates, they must exist in the
+	// namespace of each instance
+	ImagePullSecrets []string
+	// OperatorNamespace is the namespace the operator runs in, which NetworkPolicies let connect
+	OperatorNamespace string
+	// PrometheusNamespace is the namespace NetworkPolicies let scrape the exporters unless an
+	// instance lists its scrapers
+	PrometheusNamespace string
+	// UpgradeImage runs pg_upgrade unless an instance sets spec.postgresql.upgradeImage, see
+	// DefaultUpgradeImage
+	UpgradeImage string
 }
 
 // +kubebuilder:rbac:groups=postgres.snappcloud.io,resources=postgreses,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=postgres.snappcloud.io,resources=postgreses/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=postgres.snappcloud.io,resources=postgreses/finalizers,verbs=update
 // +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheusrules,verbs=get;list;watch;create;update;patch;delete
 
 func (r *PostgresReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
 	// Fetch the Postgres instance
-	var postgres postgresv1alpha1.Postgres
+	var postgres postgresv1beta1.Postgres
 	if err := r.Get(ctx, req.NamespacedName, &postgres); err != nil {
 		if apierrors.IsNotFound(err) {
 			logger.Info("Postgres resource not found. Ignoring since object must be deleted")
@@ -46,35 +116,64 @@ func (r *PostgresReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{}, err
 	}
 
+	// Apply the same defaults as the mutating webhook, in case it is not deployed
+	postgres.SetDefaults()
+
 	// Check if the resource is being deleted
 	if !postgres.ObjectMeta.DeletionTimestamp.IsZero() {
-		if containsString(postgres.ObjectMeta.Finalizers, "postgres.finalizer") {
-			if err := r.finalizerPostgres(&postgres); err != nil {
+		if containsString(postgres.ObjectMeta.Finalizers, postgresFinalizer) {
+			if postgres.Status.Phase != postgresv1beta1.PostgresPhaseDeleting {
+				postgres.Status.Phase = postgresv1beta1.PostgresPhaseDeleting
+				if err := r.Status().Update(ctx, &postgres); err != nil {
+					reconcileErrors.WithLabelValues(stepStatus).Inc()
+					logger.Error(err, "unable to update Postgres status")
+					return ctrl.Result{}, err
+				}
+				r.Recorder.Eventf(&postgres, corev1.EventTypeNormal, eventDeleting, "Cleaning up with deletion policy %s", deletionPolicy(&postgres))
+			}
+			requeueAfter, err := r.finalizerPostgres(ctx, &postgres)
+			if err != nil {
+				logger.Error(err, "Failed to clean up Postgres", "Postgres.Name", postgres.Name)
 				return ctrl.Result{}, err
 			}
+			if requeueAfter > 0 {
+				return ctrl.Result{RequeueAfter: requeueAfter}, nil
+			}
 
 			// Remove finalizer after cleanup
-			postgres.ObjectMeta.Finalizers = removeString(postgres.ObjectMeta.Finalizers, "postgres.finalizer")
+			postgres.ObjectMeta.Finalizers = removeString(postgres.ObjectMeta.Finalizers, postgresFinalizer)
 			if err := r.Update(ctx, &postgres); err != nil {
 				return ctrl.Result{}, err
 			}
+			r.Recorder.Event(&postgres, corev1.EventTypeNormal, eventDeleted, "Cleanup finished, finalizer removed")
 		}
 		return ctrl.Result{}, nil
 
 	}
 
 	// Add finalizer if not exist
-	if !containsString(postgres.ObjectMeta.Finalizers, "postgres.finalizer") {
-		postgres.ObjectMeta.Finalizers = append(postgres.ObjectMeta.Finalizers, "postgres.finalizer")
+	if !containsString(postgres.ObjectMeta.Finalizers, postgresFinalizer) {
+		postgres.ObjectMeta.Finalizers = append(postgres.ObjectMeta.Finalizers, postgresFinalizer)
 		if err := r.Update(ctx, &postgres); err != nil {
 			return ctrl.Result{}, nil
 		}
 	}
 
+	// Generate the credentials when the Secret is left to the operator
+	if postgres.Spec.Auth.SecretRef == postgres.GeneratedSecretName() {
+		if err := r.reconcileGeneratedSecret(ctx, &postgres); err != nil {
+			reconcileErrors.WithLabelValues(stepSecret).Inc()
+			logger.Error(err, "Failed to reconcile generated credentials", "Secret", postgres.Spec.Auth.SecretRef)
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Fetch the refrenced secret for db credentials
 	var secret corev1.Secret
 	if err := r.Get(ctx, types.NamespacedName{Name: postgres.Spec.Auth.SecretRef, Namespace: req.Namespace}, &secret); err != nil {
+		reconcileErrors.WithLabelValues(stepSecret).Inc()
 		if errors.IsNotFound(err) {
+			r.Recorder.Eventf(&postgres, corev1.EventTypeWarning, eventSecretMissing, "Secret %s not found", postgres.Spec.Auth.SecretRef)
 			logger.Error(err, "Referenced Secret not found", "Secret", postgres.Spec.Auth.SecretRef)
 			return ctrl.Result{}, err
 		}
@@ -82,156 +181,621 @@ func (r *PostgresReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 	}
 
+	for _, key := range []string{usernameKey(&postgres), passwordKey(&postgres)} {
+		if _, ok := secret.Data[key]; !ok {
+			err := fmt.Errorf("key %q not found in Secret %s", key, secret.Name)
+			reconcileErrors.WithLabelValues(stepSecret).Inc()
+			r.Recorder.Event(&postgres, corev1.EventTypeWarning, eventSecretMissing, err.Error())
+			logger.Error(err, "Referenced Secret is missing a credentials key", "Secret", secret.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The webhook rejects invalid sizes, but it can be disabled
+	if _, err := resource.ParseQuantity(postgres.Spec.Storage.Size); err != nil {
+		r.Recorder.Eventf(&postgres, corev1.EventTypeWarning, eventInvalidSpec, "Invalid persistence size %q: %v", postgres.Spec.Storage.Size, err)
+		logger.Error(err, "Invalid persistence size", "Size", postgres.Spec.Storage.Size)
+		return ctrl.Result{}, err
+	}
+
+	// Ensure the server certificate when TLS is enabled
+	var tlsSecret *corev1.Secret
+	var renewAt time.Time
+	if postgres.Spec.TLS != nil {
+		var err error
+		tlsSecret, renewAt, err = r.reconcileTLS(ctx, &postgres)
+		if err != nil {
+			reconcileErrors.WithLabelValues(stepTLS).Inc()
+			logger.Error(err, "Failed to reconcile TLS certificate", "Secret", tlsSecretName(&postgres))
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Ensure the credentials of the monitoring role when monitoring is enabled
+	if err := r.reconcileMonitoringSecret(ctx, &postgres); err != nil {
+		reconcileErrors.WithLabelValues(stepMonitoring).Inc()
+		logger.Error(err, "Failed to reconcile monitoring Secret", "Secret", monitoringSecretName(&postgres))
+		return ctrl.Result{}, err
+	}
+
+	// Load and validate the custom exporter queries
+	queries, err := r.reconcileCustomQueries(ctx, &postgres)
+	if err != nil {
+		reconcileErrors.WithLabelValues(stepMonitoring).Inc()
+		logger.Error(err, "Failed to reconcile custom queries", "ConfigMap", customQueriesConfigMapName(&postgres))
+		return ctrl.Result{}, err
+	}
+
+	// Ensure the server configuration is up to date
+	config := r.configMapForPostgres(&postgres)
+	if err := r.reconcileConfigMap(ctx, &postgres, config); err != nil {
+		reconcileErrors.WithLabelValues(stepConfig).Inc()
+		logger.Error(err, "Failed to reconcile ConfigMap", "ConfigMap.Namespace", config.Namespace, "ConfigMap.Name", config.Name)
+		return ctrl.Result{}, err
+	}
+
+	// Resolve the image of the running version, catalogs and overrides are read on every reconcile
+	image, err := r.resolveImage(ctx, &postgres, postgresVersion(&postgres))
+	if err != nil {
+		reconcileErrors.WithLabelValues(stepImage).Inc()
+		r.Recorder.Eventf(&postgres, corev1.EventTypeWarning, eventInvalidSpec, "Cannot resolve the image: %v", err)
+		logger.Error(err, "Failed to resolve image", "Version", postgresVersion(&postgres))
+		return ctrl.Result{}, err
+	}
+
 	// Ensure the statefulset is existing
+	desired := r.statefulSetForPostgres(&postgres, &secret, config, tlsSecret, queries, image)
 	statefulsetName := postgres.Name
 	var statefulset appsv1.StatefulSet
-	err := r.Get(ctx, types.NamespacedName{Name: statefulsetName, Namespace: req.Namespace}, &statefulset)
+	err = r.Get(ctx, types.NamespacedName{Name: statefulsetName, Namespace: req.Namespace}, &statefulset)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Define a new StatefulSet
-			sts := r.statefulSetForPostgres(&postgres, &secret)
+			sts := desired
 
 			// Set the Postgres instance as the owner and controller of the StatefulSet
 			if err := ctrl.SetControllerReference(&postgres, sts, r.Scheme); err != nil {
+				reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
 				logger.Error(err, "Failed to set owner reference on StatefulSet")
 				return ctrl.Result{}, err
 			}
 
 			logger.Info("Creating a new StatefulSet", "StatefulSet.Namespace", sts.Namespace, "StatefulSet.Name", sts.Name)
 			if err := r.Create(ctx, sts); err != nil {
+				reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
 				logger.Error(err, "Failed to create new StatefulSet", "StatefulSet.Namespace", sts.Namespace, "StatefulSet.Name", sts.Name)
 				return ctrl.Result{}, err
 			}
+			r.Recorder.Eventf(&postgres, corev1.EventTypeNormal, eventCreated, "Created StatefulSet %s", sts.Name)
 			// StatefulSet created successfully - return and requeue
 			return ctrl.Result{Requeue: true}, nil
 		} else {
+			reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
 			logger.Error(err, "Failed to get StatefulSet")
 			return ctrl.Result{}, err
 		}
 	}
 
+	// Label StatefulSets created by earlier versions, the deletion protection webhook only sees labelled ones
+	if statefulset.Labels[postgresv1beta1.InstanceLabel] != postgres.Name {
+		if statefulset.Labels == nil {
+			statefulset.Labels = map[string]string{}
+		}
+		statefulset.Labels[postgresv1beta1.InstanceLabel] = postgres.Name
+		if err := r.Update(ctx, &statefulset); err != nil {
+			reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
+			logger.Error(err, "Failed to label StatefulSet", "StatefulSet.Namespace", statefulset.Namespace, "StatefulSet.Name", statefulset.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Run a major version upgrade, it takes over the StatefulSet until it is done
+	if requeueAfter, err := r.reconcileUpgrade(ctx, &postgres, &statefulset, desired, &secret); err != nil {
+		reconcileErrors.WithLabelValues(stepUpgrade).Inc()
+		logger.Error(err, "Failed to upgrade", "Postgres.Name", postgres.Name)
+		return ctrl.Result{}, err
+	} else if requeueAfter > 0 {
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	// Roll the pods when the pod template changed, e.g. after the referenced Secret or the version changed
+	if statefulset.Annotations[templateHashAnnotation] != desired.Annotations[templateHashAnnotation] {
+		logger.Info("Updating StatefulSet pod template", "StatefulSet.Namespace", statefulset.Namespace, "StatefulSet.Name", statefulset.Name)
+		if statefulset.Annotations == nil {
+			statefulset.Annotations = map[string]string{}
+		}
+		statefulset.Annotations[templateHashAnnotation] = desired.Annotations[templateHashAnnotation]
+		oldImage := statefulset.Spec.Template.Spec.Containers[0].Image
+		startRollout(&statefulset, desired.Spec.Template)
+		if err := r.Update(ctx, &statefulset); err != nil {
+			reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
+			logger.Error(err, "Failed to update StatefulSet", "StatefulSet.Namespace", statefulset.Namespace, "StatefulSet.Name", statefulset.Name)
+			return ctrl.Result{}, err
+		}
+		// The primary pod is replaced on purpose, this is not a failover
+		postgres.Status.CurrentPrimaryUID = ""
+		if err := r.Status().Update(ctx, &postgres); err != nil {
+			reconcileErrors.WithLabelValues(stepStatus).Inc()
+			logger.Error(err, "unable to update Postgres status")
+			return ctrl.Result{}, err
+		}
+		if image := desired.Spec.Template.Spec.Containers[0].Image; image != oldImage {
+			r.Recorder.Eventf(&postgres, corev1.EventTypeNormal, eventRollingUpdate, "Updating image from %s to %s, standbys first", oldImage, image)
+		} else {
+			r.Recorder.Event(&postgres, corev1.EventTypeNormal, eventRestarting, "Pod template changed, restarting the pods")
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	// Continue a rolling update, the primary is updated after all standbys
+	if rolling, err := r.reconcileRollout(ctx, &postgres, &statefulset); err != nil {
+		reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
+		logger.Error(err, "Failed to roll out StatefulSet", "StatefulSet.Name", statefulset.Name)
+		return ctrl.Result{}, err
+	} else if rolling {
+		return ctrl.Result{RequeueAfter: rolloutPollInterval}, nil
+	}
+
+	// Report data volumes that do not have the requested size
+	if err := r.reconcileStorage(ctx, &postgres, &statefulset); err != nil {
+		reconcileErrors.WithLabelValues(stepStatefulSet).Inc()
+		logger.Error(err, "Failed to check the size of the data volumes", "StatefulSet.Name", statefulset.Name)
+		return ctrl.Result{}, err
+	}
+
+	// Limit voluntary evictions of the pods
+	if err := r.reconcilePodDisruptionBudgets(ctx, &postgres, &statefulset); err != nil {
+		reconcileErrors.WithLabelValues(stepDisruption).Inc()
+		logger.Error(err, "Failed to reconcile PodDisruptionBudgets", "Postgres.Name", postgres.Name)
+		return ctrl.Result{}, err
+	}
+
+	// Restrict the connections to the listed clients
+	if err := r.reconcileNetworkPolicy(ctx, &postgres, queries); err != nil {
+		reconcileErrors.WithLabelValues(stepNetwork).Inc()
+		logger.Error(err, "Failed to reconcile NetworkPolicy", "Postgres.Name", postgres.Name)
+		return ctrl.Result{}, err
+	}
+
 	// Ensure the service is existing
-	serviceName := "postgres-service"
 	var service corev1.Service
-	err = r.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: req.Namespace}, &service)
+	err = r.Get(ctx, types.NamespacedName{Name: serviceName(&postgres), Namespace: req.Namespace}, &service)
 	if err != nil && errors.IsNotFound(err) {
 		// Define a new Service
-		svc := r.serviceForPostgres(&postgres)
+		svc := r.serviceForPostgres(&postgres, queries)
 
 		// Set the Postgres instance as the owner and controller of the StatefulSet
 		if err := ctrl.SetControllerReference(&postgres, svc, r.Scheme); err != nil {
+			reconcileErrors.WithLabelValues(stepService).Inc()
 			logger.Error(err, "Failed to set owner reference on Service")
 			return ctrl.Result{}, err
 		}
 		logger.Info("Creating a new Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
 		if err := r.Create(ctx, svc); err != nil {
+			reconcileErrors.WithLabelValues(stepService).Inc()
 			logger.Error(err, "Failed to create new Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
 			return ctrl.Result{}, err
 		}
 		// Service created successfully - return and requeue
 		return ctrl.Result{Requeue: true}, nil
 	} else if err != nil {
+		reconcileErrors.WithLabelValues(stepService).Inc()
 		logger.Error(err, "Failed to get Service")
 		return ctrl.Result{}, err
 	}
 
+	// Keep the exposed ports in line with the spec, e.g. the metrics port, and follow a blue/green cutover
+	if desiredSvc := r.serviceForPostgres(&postgres, queries); !equality.Semantic.DeepEqual(service.Spec.Ports, desiredSvc.Spec.Ports) ||
+		!equality.Semantic.DeepEqual(service.Spec.Selector, desiredSvc.Spec.Selector) {
+		logger.Info("Updating Service", "Service.Namespace", service.Namespace, "Service.Name", service.Name)
+		service.Spec.Ports = desiredSvc.Spec.Ports
+		service.Spec.Selector = desiredSvc.Spec.Selector
+		if err := r.Update(ctx, &service); err != nil {
+			reconcileErrors.WithLabelValues(stepService).Inc()
+			logger.Error(err, "Failed to update Service", "Service.Namespace", service.Namespace, "Service.Name", service.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Keep the shared Service of earlier versions for the clients still using it
+	if err := r.reconcileLegacyService(ctx, &postgres, queries); err != nil {
+		reconcileErrors.WithLabelValues(stepService).Inc()
+		logger.Error(err, "Failed to reconcile Service", "Service.Namespace", postgres.Namespace, "Service.Name", legacyServiceName)
+		return ctrl.Result{}, err
+	}
+
+	// Ensure the ServiceMonitor when monitoring is enabled
+	if err := r.reconcileServiceMonitor(ctx, &postgres, queries); err != nil {
+		reconcileErrors.WithLabelValues(stepMonitoring).Inc()
+		logger.Error(err, "Failed to reconcile ServiceMonitor")
+		return ctrl.Result{}, err
+	}
+
+	// Ensure the default alerts when monitoring is enabled
+	if err := r.reconcilePrometheusRule(ctx, &postgres); err != nil {
+		reconcileErrors.WithLabelValues(stepMonitoring).Inc()
+		logger.Error(err, "Failed to reconcile PrometheusRule")
+		return ctrl.Result{}, err
+	}
+
+	// Ensure the connection pooler matches the spec
+	if err := r.reconcilePooler(ctx, &postgres); err != nil {
+		reconcileErrors.WithLabelValues(stepPooler).Inc()
+		logger.Error(err, "Failed to reconcile pooler", "Pooler.Name", poolerName(&postgres))
+		return ctrl.Result{}, err
+	}
+
 	// Check if the StatefulSet is ready
 	if statefulset.Status.ReadyReplicas != *statefulset.Spec.Replicas {
-		if postgres.Status.Ready {
+		phase := postgresv1beta1.PostgresPhaseNotReady
+		if postgres.Status.Phase == "" || postgres.Status.Phase == postgresv1beta1.PostgresPhaseCreating {
+			phase = postgresv1beta1.PostgresPhaseCreating
+		}
+		changed := meta.SetStatusCondition(&postgres.Status.Conditions, metav1.Condition{
+			Type:               postgresv1beta1.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             string(phase),
+			Message:            fmt.Sprintf("%d of %d pods are ready", statefulset.Status.ReadyReplicas, *statefulset.Spec.Replicas),
+			ObservedGeneration: postgres.Generation,
+		})
+		if changed || postgres.Status.Ready || postgres.Status.Phase != phase {
 			postgres.Status.Ready = false
+			postgres.Status.Phase = phase
 
 			if err := r.Status().Update(ctx, &postgres); err != nil {
+				reconcileErrors.WithLabelValues(stepStatus).Inc()
 				logger.Error(err, "unable to update Postgres status")
 				return ctrl.Result{}, err
 			}
+			if phase == postgresv1beta1.PostgresPhaseNotReady {
+				r.Recorder.Eventf(&postgres, corev1.EventTypeWarning, eventNotReady, "%d of %d pods are ready",
+					statefulset.Status.ReadyReplicas, *statefulset.Spec.Replicas)
+			}
 		}
 		logger.Info("StatefulSet is not ready yet", "StatefulSet.Name", statefulset.Name)
 		return ctrl.Result{RequeueAfter: 15 * time.Second}, nil // allows the operator to requeue after 5.
 	}
 
 	// If StatefulSet is ready, ensure Postgres Ready status is true
-	if !postgres.Status.Ready {
+	primary, err := r.primaryPod(ctx, &postgres)
+	if err != nil {
+		reconcileErrors.WithLabelValues(stepStatus).Inc()
+		logger.Error(err, "Failed to get primary pod")
+		return ctrl.Result{}, err
+	}
+	// The running version only changes once every pod runs the current template
+	version, image := postgres.Status.Version, postgres.Status.Image
+	if statefulset.Status.ObservedGeneration == statefulset.Generation &&
+		statefulset.Status.CurrentRevision == statefulset.Status.UpdateRevision {
+		version = postgresVersion(&postgres)
+		image = statefulset.Spec.Template.Spec.Containers[0].Image
+	}
+	changed := meta.SetStatusCondition(&postgres.Status.Conditions, metav1.Condition{
+		Type:               postgresv1beta1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             string(postgresv1beta1.PostgresPhaseReady),
+		Message:            "All pods are ready",
+		ObservedGeneration: postgres.Generation,
+	})
+	if changed || !postgres.Status.Ready || postgres.Status.Phase != postgresv1beta1.PostgresPhaseReady ||
+		postgres.Status.CurrentPrimaryUID != string(primary.UID) || postgres.Status.Version != version || postgres.Status.Image != image {
+		if postgres.Status.Phase == "" || postgres.Status.Phase == postgresv1beta1.PostgresPhaseCreating {
+			timeToReady.Observe(time.Since(postgres.CreationTimestamp.Time).Seconds())
+		}
+		if postgres.Status.CurrentPrimaryUID != "" && postgres.Status.CurrentPrimaryUID != string(primary.UID) {
+			failovers.WithLabelValues(postgres.Namespace, postgres.Name).Inc()
+			r.Recorder.Eventf(&postgres, corev1.EventTypeWarning, eventFailover, "Primary pod %s was replaced", primary.Name)
+		}
+		wasReady := postgres.Status.Ready
+		oldVersion := postgres.Status.Version
+		postgres.Status.Version = version
+		postgres.Status.Image = image
 		postgres.Status.Ready = true
+		postgres.Status.Phase = postgresv1beta1.PostgresPhaseReady
+		postgres.Status.CurrentPrimary = primary.Name
+		postgres.Status.CurrentPrimaryUID = string(primary.UID)
 		if err := r.Status().Update(ctx, &postgres); err != nil {
+			reconcileErrors.WithLabelValues(stepStatus).Inc()
 			logger.Error(err, "unable to update Postgres status")
 			return ctrl.Result{}, err
 		}
 		logger.Info("Postgres resource is ready", "Postgres.Name", postgres.Name)
+		if !wasReady {
+			r.Recorder.Event(&postgres, corev1.EventTypeNormal, eventReady, "Instance is ready")
+		}
+		if oldVersion != "" && oldVersion != version {
+			r.Recorder.Eventf(&postgres, corev1.EventTypeNormal, eventUpdated, "Updated from version %s to %s", oldVersion, version)
+		}
 
 	}
-	return ctrl.Result{}, nil
+
+	// Run a blue/green upgrade next to the instance while it keeps serving
+	blueGreenAfter, err := r.reconcileBlueGreen(ctx, &postgres, desired, &secret)
+	if err != nil {
+		reconcileErrors.WithLabelValues(stepUpgrade).Inc()
+		logger.Error(err, "Failed to upgrade", "Postgres.Name", postgres.Name)
+		return ctrl.Result{}, err
+	}
+	if blueGreenReadOnly(&postgres) {
+		return ctrl.Result{RequeueAfter: blueGreenAfter}, nil
+	}
+
+	// Ensure the roles and objects the operator manages inside the database
+	if err := r.reconcileDatabase(ctx, &postgres, &secret); err != nil {
+		reconcileErrors.WithLabelValues(stepDatabase).Inc()
+		logger.Error(err, "Failed to reconcile database objects", "Postgres.Name", postgres.Name)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// Come back when the operator issued certificates are due for renewal
+	if !renewAt.IsZero() && (blueGreenAfter == 0 || time.Until(renewAt) < blueGreenAfter) {
+		return ctrl.Result{RequeueAfter: time.Until(renewAt)}, nil
+	}
+	return ctrl.Result{RequeueAfter: blueGreenAfter}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PostgresReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := metrics.Registry.Register(&instanceCollector{reader: mgr.GetCache()}); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &postgresv1beta1.Postgres{}, secretRefField, indexSecretRef); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &postgresv1beta1.Postgres{}, tlsSecretRefField, indexTLSSecretRef); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &postgresv1beta1.Postgres{}, imageCatalogRefField, func(obj client.Object) []string {
+		pg := obj.(*postgresv1beta1.Postgres)
+		if pg.Spec.ImageCatalogRef == nil {
+			return nil
+		}
+		return []string{pg.Spec.ImageCatalogRef.Name}
+	}); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &postgresv1beta1.Postgres{}, customQueriesField, func(obj client.Object) []string {
+		pg := obj.(*postgresv1beta1.Postgres)
+		if pg.Spec.Monitoring == nil {
+			return nil
+		}
+		var names []string
+		for _, ref := range pg.Spec.Monitoring.CustomQueries {
+			names = append(names, ref.Name)
+		}
+		return names
+	}); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&postgresv1alpha1.Postgres{}).
+		For(&postgresv1beta1.Postgres{}).
 		Owns(&appsv1.StatefulSet{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&batchv1.Job{}).
 		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Watches(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.findPostgresForSecret),
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
+		).
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.findPostgresForConfigMap),
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
+		).
+		Watches(
+			&postgresv1beta1.ImageCatalog{},
+			handler.EnqueueRequestsFromMapFunc(r.findPostgresForImageCatalog),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
 		Complete(r)
 }
 
+// postgresProbe returns a probe running check with the timing from the spec
+func postgresProbe(timing *postgresv1beta1.ProbeTiming, check corev1.ProbeHandler) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler:        check,
+		InitialDelaySeconds: timing.InitialDelaySeconds,
+		PeriodSeconds:       timing.PeriodSeconds,
+		TimeoutSeconds:      timing.TimeoutSeconds,
+		FailureThreshold:    timing.FailureThreshold,
+	}
+}
+
+// reconcileGeneratedSecret creates the default credentials Secret with a random password. An
+// existing Secret is left alone, so users can still supply it under the default name.
+func (r *PostgresReconciler) reconcileGeneratedSecret(ctx context.Context, pg *postgresv1beta1.Postgres) error {
+	var existing corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Name: pg.Spec.Auth.SecretRef, Namespace: pg.Namespace}, &existing)
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pg.Spec.Auth.SecretRef,
+			Namespace: pg.Namespace,
+			Labels:    map[string]string{"app": pg.Name},
+		},
+		Data: map[string][]byte{
+			usernameKey(pg): []byte("postgres"),
+			passwordKey(pg): []byte(password),
+		},
+	}
+	if err := ctrl.SetControllerReference(pg, secret, r.Scheme); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Creating a new Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+	return r.Create(ctx, secret)
+}
+
+// primaryPod returns the pod serving the instance
+func (r *PostgresReconciler) primaryPod(ctx context.Context, pg *postgresv1beta1.Postgres) (*corev1.Pod, error) {
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Name: pg.Name + "-0", Namespace: pg.Namespace}, &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+// indexSecretRef returns the credentials Secret of a Postgres for the secretRefField index
+func indexSecretRef(obj client.Object) []string {
+	pg := obj.(*postgresv1beta1.Postgres)
+	if pg.Spec.Auth.SecretRef == "" {
+		return nil
+	}
+	return []string{pg.Spec.Auth.SecretRef}
+}
+
+// indexTLSSecretRef returns the certificate Secret of a Postgres for the tlsSecretRefField index
+func indexTLSSecretRef(obj client.Object) []string {
+	pg := obj.(*postgresv1beta1.Postgres)
+	if pg.Spec.TLS == nil || pg.Spec.TLS.SecretRef == "" {
+		return nil
+	}
+	return []string{pg.Spec.TLS.SecretRef}
+}
+
+// findPostgresForSecret maps a Secret to the Postgres objects referencing it
+func (r *PostgresReconciler) findPostgresForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	return r.findPostgresByFields(ctx, secret, secretRefField, tlsSecretRefField)
+}
+
+// findPostgresForConfigMap maps a ConfigMap to the Postgres objects referencing it
+func (r *PostgresReconciler) findPostgresForConfigMap(ctx context.Context, configMap client.Object) []reconcile.Request {
+	return r.findPostgresByFields(ctx, configMap, customQueriesField)
+}
+
+// findPostgresByFields returns requests for the Postgres objects in the namespace of obj whose
+// indexed fields reference it by name
+func (r *PostgresReconciler) findPostgresByFields(ctx context.Context, obj client.Object, fields ...string) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, field := range fields {
+		var postgresList postgresv1beta1.PostgresList
+		if err := r.List(ctx, &postgresList,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{field: obj.GetName()},
+		); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to list Postgres", "Field", field, "Name", obj.GetName())
+			return nil
+		}
+
+		for _, pg := range postgresList.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: pg.Name, Namespace: pg.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
 // Helper function statefulSetForPostgres returns a StatefulSet object that will be created
-func (r *PostgresReconciler) statefulSetForPostgres(pg *postgresv1alpha1.Postgres, secret *corev1.Secret) *appsv1.StatefulSet {
+func (r *PostgresReconciler) statefulSetForPostgres(pg *postgresv1beta1.Postgres, secret *corev1.Secret, config *corev1.ConfigMap,
+	tlsSecret *corev1.Secret, queries *corev1.ConfigMap, image string) *appsv1.StatefulSet {
 	labels := map[string]string{
 		"app": pg.Name,
 	}
 	replicas := int32(1)
+	partition := int32(0)
+	credentialsMode := int32(0440)
+	readyCheck := corev1.ProbeHandler{
+		Exec: &corev1.ExecAction{Command: []string{"pg_isready", "-h", "localhost", "-p", "5432"}},
+	}
+	tlsMode := int32(0640)
 
-	return &appsv1.StatefulSet{
+	sts := &appsv1.StatefulSet{
 		ObjectMeta: ctrl.ObjectMeta{
 			Name:      pg.Name,
 			Namespace: pg.Namespace,
-			Labels:    labels,
+			Labels:    map[string]string{"app": pg.Name, postgresv1beta1.InstanceLabel: pg.Name},
 		},
 		Spec: appsv1.StatefulSetSpec{
-			ServiceName: "postgres-service",
+			ServiceName: serviceName(pg),
 			Replicas:    &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
+			// reconcileRollout moves the partition to update the standbys before the primary
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
+					Annotations: map[string]string{
+						secretHashAnnotation: secretHash(secret, usernameKey(pg), passwordKey(pg)),
+						configHashAnnotation: hashObject(config.Data),
+					},
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{{
 						Name:  "postgresql",
-						Image: "postgres:" + pg.Spec.Version,
+						Image: image,
+						Args:  postgresArgs(pg, tlsSecret),
 						Ports: []corev1.ContainerPort{{
 							ContainerPort: 5432,
 							Name:          "postgres",
 						}},
-						VolumeMounts: []corev1.VolumeMount{{
-							Name:      "data",
-							MountPath: "/var/lib/postgresql/data",
-						}},
+						Resources:      *pg.Spec.Resources,
+						StartupProbe:   postgresProbe(pg.Spec.Probes.Startup, readyCheck),
+						LivenessProbe:  postgresProbe(pg.Spec.Probes.Liveness, corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("postgres")}}),
+						ReadinessProbe: postgresProbe(pg.Spec.Probes.Readiness, readyCheck),
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "data",
+								MountPath: dataMountPath,
+							},
+							{
+								Name:      "run",
+								MountPath: "/var/run/postgresql",
+							},
+							{
+								Name:      "tmp",
+								MountPath: "/tmp",
+							},
+							{
+								Name:      "credentials",
+								MountPath: credentialsMountPath,
+								ReadOnly:  true,
+							},
+							{
+								Name:      "config",
+								MountPath: configMountPath,
+								ReadOnly:  true,
+							},
+						},
 						Env: []corev1.EnvVar{
+							{
+								Name:  "PGDATA",
+								Value: pgdataPath,
+							},
 							{
 								Name:  "POSTGRES_DB",
 								Value: pg.Spec.Auth.Database,
 							},
 							{
-								Name: "POSTGRES_USER",
-								ValueFrom: &corev1.EnvVarSource{
-									SecretKeyRef: &corev1.SecretKeySelector{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: pg.Spec.Auth.SecretRef,
-										},
-										Key: "username",
-									},
-								},
+								Name:  "POSTGRES_USER_FILE",
+								Value: credentialsMountPath + "/username",
 							},
 							{
-								Name: "POSTGRES_PASSWORD",
-								ValueFrom: &corev1.EnvVarSource{
-									SecretKeyRef: &corev1.SecretKeySelector{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: pg.Spec.Auth.SecretRef,
-										},
-										Key: "password",
-									},
-								},
+								Name:  "POSTGRES_PASSWORD_FILE",
+								Value: credentialsMountPath + "/password",
 							},
 						},
 						Lifecycle: &corev1.Lifecycle{
@@ -240,17 +804,54 @@ func (r *PostgresReconciler) statefulSetForPostgres(pg *postgresv1alpha1.Postgre
 									Command: []string{
 										"/bin/sh",
 										"-c",
-										"sed -i 's/trust/md5/g' /var/lib/postgresql/data/pg_hba.conf && echo 'host all all all md5' >> /var/lib/postgresql/data/pg_hba.conf",
+										postStartScript,
 									},
 								},
 							},
 						},
 					}},
+					InitContainers: []corev1.Container{{
+						Name:    "pgdata",
+						Image:   image,
+						Command: []string{"/bin/sh", "-c", "set -eu" + pgdataLayoutScript},
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      "data",
+							MountPath: dataMountPath,
+						}},
+					}},
+					Volumes: []corev1.Volume{
+						scratchVolume("run"),
+						scratchVolume("tmp"),
+						{
+							Name: "credentials",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: pg.Spec.Auth.SecretRef,
+									Items: []corev1.KeyToPath{
+										{Key: usernameKey(pg), Path: "username"},
+										{Key: passwordKey(pg), Path: "password"},
+									},
+									DefaultMode: &credentialsMode,
+								},
+							},
+						},
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: config.Name,
+									},
+								},
+							},
+						},
+					},
 				},
 			},
 			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: "data",
+					Name:   "data",
+					Labels: dataClaimLabels(pg),
 				},
 				Spec: corev1.PersistentVolumeClaimSpec{
 					AccessModes: []corev1.PersistentVolumeAccessMode{
@@ -258,39 +859,230 @@ func (r *PostgresReconciler) statefulSetForPostgres(pg *postgresv1alpha1.Postgre
 					},
 					Resources: corev1.VolumeResourceRequirements{
 						Requests: corev1.ResourceList{
-							"storage": resource.MustParse(pg.Spec.Persistence.Size),
+							"storage": resource.MustParse(pg.Spec.Storage.Size),
 						},
 					},
 				},
 			}},
 		},
 	}
+
+	podSpec := &sts.Spec.Template.Spec
+	if monitoringEnabled(pg) {
+		podSpec.Containers = append(podSpec.Containers, exporterContainers(pg, queries)...)
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "monitoring",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  monitoringSecretName(pg),
+					DefaultMode: &credentialsMode,
+				},
+			},
+		})
+		if queries != nil {
+			sts.Spec.Template.Annotations[queriesHashAnnotation] = hashObject(queries.Data)
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name: "monitoring-queries",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: queries.Name},
+					},
+				},
+			})
+		}
+	}
+	if tlsSecret != nil {
+		// Postgres accepts a root owned key that is only group readable
+		sts.Spec.Template.Annotations[tlsHashAnnotation] = secretHash(tlsSecret, corev1.TLSCertKey, corev1.TLSPrivateKeyKey, caCertKey)
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "tls",
+			MountPath: tlsMountPath,
+			ReadOnly:  true,
+		})
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "tls",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  tlsSecret.Name,
+					DefaultMode: &tlsMode,
+				},
+			},
+		})
+	}
+
+	applyScheduling(pg, podSpec)
+	applyPodSecurity(pg, podSpec)
+	r.applyImageSettings(pg, podSpec)
+
+	sts.Annotations = map[string]string{
+		templateHashAnnotation: hashObject(sts.Spec.Template),
+	}
+	return sts
 }
 
 // Helper function serviceForPostgres returns a Service object to expose the Postgres
-func (r *PostgresReconciler) serviceForPostgres(pg *postgresv1alpha1.Postgres) *corev1.Service {
+func (r *PostgresReconciler) serviceForPostgres(pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) *corev1.Service {
 	labels := map[string]string{
 		"app": pg.Name,
 	}
+	selector := map[string]string{
+		"app": servingName(pg),
+	}
+
+	ports := []corev1.ServicePort{{
+		Port:       5432,
+		Name:       "postgres",
+		Protocol:   corev1.ProtocolTCP,
+		TargetPort: intstr.FromInt32(5432),
+	}}
+	if monitoringEnabled(pg) {
+		for i := range exporterDatabases(pg, queries) {
+			ports = append(ports, corev1.ServicePort{
+				Port:       int32(exporterPort + i),
+				Name:       exporterPortName(i),
+				Protocol:   corev1.ProtocolTCP,
+				TargetPort: intstr.FromString(exporterPortName(i)),
+			})
+		}
+	}
 
 	return &corev1.Service{
 		ObjectMeta: ctrl.ObjectMeta{
-			Name:      "postgres-service",
+			Name:      serviceName(pg),
 			Namespace: pg.Namespace,
 			Labels:    labels,
 		},
 		Spec: corev1.ServiceSpec{
-			Ports: []corev1.ServicePort{{
-				Port:     5432,
-				Name:     "postgres",
-				Protocol: corev1.ProtocolTCP,
-			}},
-			Selector: labels,
+			Ports:    ports,
+			Selector: selector,
 			Type:     corev1.ServiceTypeClusterIP,
 		},
 	}
 }
 
+// ownedLegacyService returns the Service postgres-service when pg owns it, nil otherwise
+func (r *PostgresReconciler) ownedLegacyService(ctx context.Context, pg *postgresv1beta1.Postgres) (*corev1.Service, error) {
+	var service corev1.Service
+	if err := r.Get(ctx, types.NamespacedName{Name: legacyServiceName, Namespace: pg.Namespace}, &service); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(&service, pg) {
+		return nil, nil
+	}
+	return &service, nil
+}
+
+// keepLegacyService reports whether pg has not opted out of the Service postgres-service
+func keepLegacyService(pg *postgresv1beta1.Postgres) bool {
+	return pg.Annotations[postgresv1beta1.LegacyServiceAnnotation] != postgresv1beta1.LegacyServiceRemove
+}
+
+// reconcileLegacyService keeps the Service postgres-service an instance created by an earlier
+// version of the operator owns in line with the Service of the instance, so its clients keep
+// working. It is only deleted once the LegacyServiceAnnotation asks for it. New instances do not
+// get one.
+func (r *PostgresReconciler) reconcileLegacyService(ctx context.Context, pg *postgresv1beta1.Postgres, queries *corev1.ConfigMap) error {
+	service, err := r.ownedLegacyService(ctx, pg)
+	if err != nil || service == nil {
+		return err
+	}
+	if !keepLegacyService(pg) {
+		log.FromContext(ctx).Info("Deleting Service", "Service.Namespace", service.Namespace, "Service.Name", service.Name)
+		if err := r.Delete(ctx, service); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleted, "Deleted Service %s", service.Name)
+		return nil
+	}
+	desired := r.serviceForPostgres(pg, queries)
+	if equality.Semantic.DeepEqual(service.Spec.Ports, desired.Spec.Ports) && equality.Semantic.DeepEqual(service.Spec.Selector, desired.Spec.Selector) {
+		return nil
+	}
+	service.Spec.Ports = desired.Spec.Ports
+	service.Spec.Selector = desired.Spec.Selector
+	return r.Update(ctx, service)
+}
+
+// postStartScript waits for the final server (not the initdb one) to come up and applies the
+// password from the Secret, so a rotated password takes effect as soon as the pod is restarted.
+// It relies on the local socket being trusted by the generated pg_hba.conf.
+const postStartScript = `
+until [ "$(cat /proc/1/comm)" = postgres ] && pg_isready -q; do sleep 1; done
+user="$(cat "$POSTGRES_USER_FILE")"` + asPostgresScript + `$as_postgres psql -v ON_ERROR_STOP=1 -v user="$user" -U "$user" -d postgres <<'SQL'
+\set password ` + "`cat " + credentialsMountPath + "/password`" + `
+ALTER ROLE :"user" WITH PASSWORD :'password';
+SQL
+`
+
+// usernameKey returns the Secret key holding the username
+func usernameKey(pg *postgresv1beta1.Postgres) string {
+	if pg.Spec.Auth.UsernameKey != "" {
+		return pg.Spec.Auth.UsernameKey
+	}
+	return "username"
+}
+
+// passwordKey returns the Secret key holding the password
+func passwordKey(pg *postgresv1beta1.Postgres) string {
+	if pg.Spec.Auth.PasswordKey != "" {
+		return pg.Spec.Auth.PasswordKey
+	}
+	return "password"
+}
+
+// hashObject returns a stable hash of the JSON representation of obj
+func hashObject(obj interface{}) string {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// secretHash returns a stable hash of the given Secret keys
+func secretHash(secret *corev1.Secret, keys ...string) string {
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(secret.Data[key])
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// reconcileOwned creates obj or updates it through mutate, keeping pg as its controller
+func (r *PostgresReconciler) reconcileOwned(ctx context.Context, pg *postgresv1beta1.Postgres, obj client.Object, mutate func() error) error {
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, func() error {
+		if err := mutate(); err != nil {
+			return err
+		}
+		return ctrl.SetControllerReference(pg, obj, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if result != controllerutil.OperationResultNone {
+		gvk, _ := apiutil.GVKForObject(obj, r.Scheme)
+		log.FromContext(ctx).Info("Reconciled "+gvk.Kind, "Namespace", obj.GetNamespace(), "Name", obj.GetName(), "Operation", result)
+	}
+	return nil
+}
+
+// deleteOwned deletes obj when it exists and is controlled by pg
+func (r *PostgresReconciler) deleteOwned(ctx context.Context, pg *postgresv1beta1.Postgres, obj client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, pg) {
+		return nil
+	}
+	gvk, _ := apiutil.GVKForObject(obj, r.Scheme)
+	log.FromContext(ctx).Info("Deleting "+gvk.Kind, "Namespace", obj.GetNamespace(), "Name", obj.GetName())
+	return client.IgnoreNotFound(r.Delete(ctx, obj))
+}
+
 func containsString(slice []string, s string) bool {
 	for _, item := range slice {
 		if item == s {
@@ -309,26 +1101,3 @@ func removeString(slice []string, s string) []string {
 	}
 	return result
 }
-
-func (r *PostgresReconciler) finalizerPostgres(postgres *postgresv1alpha1.Postgres) error {
-	statefulsetName := postgres.Name
-	var statefulset appsv1.StatefulSet
-	err := r.Get(context.TODO(), types.NamespacedName{Name: statefulsetName, Namespace: postgres.Namespace}, &statefulset)
-	if err == nil {
-		if err := r.Delete(context.TODO(), &statefulset); err != nil {
-			return err
-		}
-	}
-	log.Log.Info("Finalizer cleanup started for Postgres", "Postgres.Name", postgres.Name)
-	time.Sleep(10 * time.Second)
-
-	serviceName := "postgres-service"
-	var service corev1.Service
-	err = r.Get(context.TODO(), types.NamespacedName{Name: serviceName, Namespace: postgres.Namespace}, &service)
-	if err == nil {
-		if err := r.Delete(context.TODO(), &service); err != nil {
-			return err
-		}
-	}
-	return nil
-}
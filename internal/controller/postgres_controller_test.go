@@ -21,13 +21,18 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	postgresv1alpha1 "github.com/rezacloner1372/postgresql-operator/api/v1alpha1"
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
 )
 
 var _ = Describe("Postgres Controller", func() {
@@ -40,13 +45,13 @@ var _ = Describe("Postgres Controller", func() {
 			Name:      resourceName,
 			Namespace: "default", // TODO(user):Modify as needed
 		}
-		postgres := &postgresv1alpha1.Postgres{}
+		postgres := &postgresv1beta1.Postgres{}
 
 		BeforeEach(func() {
 			By("creating the custom resource for the Kind Postgres")
 			err := k8sClient.Get(ctx, typeNamespacedName, postgres)
 			if err != nil && errors.IsNotFound(err) {
-				resource := &postgresv1alpha1.Postgres{
+				resource := &postgresv1beta1.Postgres{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      resourceName,
 						Namespace: "default",
@@ -59,7 +64,7 @@ var _ = Describe("Postgres Controller", func() {
 
 		AfterEach(func() {
 			// TODO(user): Cleanup logic after each test, like removing the resource instance.
-			resource := &postgresv1alpha1.Postgres{}
+			resource := &postgresv1beta1.Postgres{}
 			err := k8sClient.Get(ctx, typeNamespacedName, resource)
 			Expect(err).NotTo(HaveOccurred())
 
@@ -69,8 +74,9 @@ var _ = Describe("Postgres Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &PostgresReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -82,3 +88,183 @@ var _ = Describe("Postgres Controller", func() {
 		})
 	})
 })
+
+var _ = Describe("Credentials Secret", func() {
+	var secret *corev1.Secret
+
+	BeforeEach(func() {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-credentials", Namespace: "shop"},
+			Data: map[string][]byte{
+				"username": []byte("postgres"),
+				"password": []byte("secret"),
+				"comment":  []byte("rotated by external-secrets"),
+			},
+		}
+	})
+
+	It("should hash the given keys regardless of their order", func() {
+		hash := secretHash(secret, "username", "password")
+		Expect(hash).To(Equal(secretHash(secret, "password", "username")))
+		Expect(hash).NotTo(Equal(secretHash(secret, "username")))
+
+		By("ignoring the other keys")
+		secret.Data["comment"] = []byte("edited")
+		Expect(secretHash(secret, "username", "password")).To(Equal(hash))
+
+		By("changing with the password")
+		secret.Data["password"] = []byte("rotated")
+		Expect(secretHash(secret, "username", "password")).NotTo(Equal(hash))
+	})
+
+	It("should not let a value run into the next key", func() {
+		a := &corev1.Secret{Data: map[string][]byte{"username": []byte("post"), "password": []byte("gres")}}
+		b := &corev1.Secret{Data: map[string][]byte{"username": []byte("postgres"), "password": []byte("")}}
+		Expect(secretHash(a, "username", "password")).NotTo(Equal(secretHash(b, "username", "password")))
+	})
+
+	It("should map a Secret to the instances using it for credentials or certificates", func() {
+		newPostgres := func(name, namespace string) *postgresv1beta1.Postgres {
+			pg := newTestPostgres()
+			pg.Name, pg.Namespace = name, namespace
+			return pg
+		}
+		orders := newPostgres("orders", "shop")
+		orders.Spec.Auth.SecretRef = "orders-credentials"
+		billing := newPostgres("billing", "shop")
+		billing.Spec.Auth.SecretRef = "billing-credentials"
+		billing.Spec.TLS = &postgresv1beta1.TLS{Mode: postgresv1beta1.TLSModeSecretRef, SecretRef: "orders-credentials"}
+		other := newPostgres("other", "shop")
+		other.Spec.Auth.SecretRef = "other-credentials"
+		elsewhere := newPostgres("orders", "warehouse")
+		elsewhere.Spec.Auth.SecretRef = "orders-credentials"
+
+		r := newTestReconciler()
+		r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).
+			WithObjects(orders, billing, other, elsewhere).
+			WithIndex(&postgresv1beta1.Postgres{}, secretRefField, indexSecretRef).
+			WithIndex(&postgresv1beta1.Postgres{}, tlsSecretRefField, indexTLSSecretRef).
+			Build()
+		Expect(r.findPostgresForSecret(context.Background(), secret)).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Name: "orders", Namespace: "shop"}},
+			reconcile.Request{NamespacedName: types.NamespacedName{Name: "billing", Namespace: "shop"}},
+		))
+	})
+})
+
+var _ = Describe("Credentials delivery", func() {
+	var (
+		pg     *postgresv1beta1.Postgres
+		secret *corev1.Secret
+		r      *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Auth.SecretRef = "orders-credentials"
+		pg.Spec.Auth.UsernameKey = "db-user"
+		pg.Spec.Auth.PasswordKey = "db-password"
+		pg.SetDefaults()
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-credentials", Namespace: "shop"},
+			Data:       map[string][]byte{"db-user": []byte("postgres"), "db-password": []byte("secret")},
+		}
+		r = &PostgresReconciler{}
+	})
+
+	statefulSet := func() *appsv1.StatefulSet {
+		return r.statefulSetForPostgres(pg, secret, r.configMapForPostgres(pg), nil, nil, "postgres:16")
+	}
+
+	It("should mount the configured keys as files instead of passing the password in the environment", func() {
+		spec := statefulSet().Spec.Template.Spec
+		Expect(spec.Volumes).To(ContainElement(HaveField("Secret", HaveField("Items", Equal([]corev1.KeyToPath{
+			{Key: "db-user", Path: "username"},
+			{Key: "db-password", Path: "password"},
+		})))))
+		Expect(spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "credentials", MountPath: credentialsMountPath, ReadOnly: true}))
+		Expect(spec.Containers[0].Env).To(ContainElements(
+			corev1.EnvVar{Name: "POSTGRES_USER_FILE", Value: credentialsMountPath + "/username"},
+			corev1.EnvVar{Name: "POSTGRES_PASSWORD_FILE", Value: credentialsMountPath + "/password"},
+		))
+		for _, env := range spec.Containers[0].Env {
+			Expect(env.Name).NotTo(Equal("POSTGRES_PASSWORD"))
+			Expect(env.ValueFrom).To(BeNil())
+		}
+	})
+
+	It("should apply the password from the file when the pod starts", func() {
+		postStart := statefulSet().Spec.Template.Spec.Containers[0].Lifecycle.PostStart
+		Expect(postStart.Exec.Command).To(HaveLen(3))
+		script := postStart.Exec.Command[2]
+		Expect(script).To(ContainSubstring("cat " + credentialsMountPath + "/password"))
+		Expect(script).To(ContainSubstring(`ALTER ROLE :"user" WITH PASSWORD :'password';`))
+		Expect(script).NotTo(ContainSubstring("secret"))
+	})
+
+	It("should restart the pods when the password changes", func() {
+		before := statefulSet()
+
+		By("ignoring keys the pods do not use")
+		secret.Data["password"] = []byte("unused")
+		Expect(statefulSet().Spec.Template.Annotations[secretHashAnnotation]).To(Equal(before.Spec.Template.Annotations[secretHashAnnotation]))
+
+		secret.Data["db-password"] = []byte("rotated")
+		after := statefulSet()
+		Expect(after.Spec.Template.Annotations[secretHashAnnotation]).NotTo(Equal(before.Spec.Template.Annotations[secretHashAnnotation]))
+		Expect(after.Annotations[templateHashAnnotation]).NotTo(Equal(before.Annotations[templateHashAnnotation]))
+	})
+})
+
+var _ = Describe("Legacy Service", func() {
+	var (
+		pg     *postgresv1beta1.Postgres
+		legacy *corev1.Service
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		legacy = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: legacyServiceName, Namespace: "shop"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "orders"},
+				Ports:    []corev1.ServicePort{{Name: "postgres", Port: 5432}},
+			},
+		}
+	})
+
+	getLegacy := func(r *PostgresReconciler) (*corev1.Service, error) {
+		var service corev1.Service
+		err := r.Get(context.Background(), types.NamespacedName{Name: legacyServiceName, Namespace: "shop"}, &service)
+		return &service, err
+	}
+
+	It("should keep the Service the instance owns in line with its own", func() {
+		Expect(ctrl.SetControllerReference(pg, legacy, newTestReconciler().Scheme)).To(Succeed())
+		r := newTestReconciler(pg, legacy)
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{Strategy: postgresv1beta1.UpgradeStrategyBlueGreen, Step: postgresv1beta1.UpgradeStepSwitched}
+		Expect(r.reconcileLegacyService(context.Background(), pg, nil)).To(Succeed())
+		service, err := getLegacy(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Spec.Selector).To(Equal(r.serviceForPostgres(pg, nil).Spec.Selector))
+		Expect(service.Spec.Ports).To(Equal(r.serviceForPostgres(pg, nil).Spec.Ports))
+	})
+
+	It("should remove it only when asked to", func() {
+		Expect(ctrl.SetControllerReference(pg, legacy, newTestReconciler().Scheme)).To(Succeed())
+		pg.Annotations = map[string]string{postgresv1beta1.LegacyServiceAnnotation: postgresv1beta1.LegacyServiceRemove}
+		r := newTestReconciler(pg, legacy)
+		Expect(r.reconcileLegacyService(context.Background(), pg, nil)).To(Succeed())
+		_, err := getLegacy(r)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should leave a Service it does not own alone", func() {
+		pg.Annotations = map[string]string{postgresv1beta1.LegacyServiceAnnotation: postgresv1beta1.LegacyServiceRemove}
+		r := newTestReconciler(pg, legacy)
+		Expect(r.reconcileLegacyService(context.Background(), pg, nil)).To(Succeed())
+		service, err := getLegacy(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Spec.Ports).To(Equal(legacy.Spec.Ports))
+	})
+})
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// rolloutPollInterval is how often a rolling update checks on the pod it waits for
+const rolloutPollInterval = 5 * time.Second
+
+// rolloutPartition returns the ordinal from which pods of the StatefulSet receive the current template
+func rolloutPartition(sts *appsv1.StatefulSet) int32 {
+	if sts.Spec.UpdateStrategy.RollingUpdate == nil || sts.Spec.UpdateStrategy.RollingUpdate.Partition == nil {
+		return 0
+	}
+	return *sts.Spec.UpdateStrategy.RollingUpdate.Partition
+}
+
+// startRollout applies a new pod template to the StatefulSet without restarting any pod yet except
+// the standby with the highest ordinal. reconcileRollout moves the partition down from there.
+func startRollout(sts *appsv1.StatefulSet, template corev1.PodTemplateSpec) {
+	partition := *sts.Spec.Replicas - 1
+	sts.Spec.Template = template
+	sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{
+		Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+	}
+}
+
+// reconcileRollout advances a rolling update of the StatefulSet and reports whether it is still in
+// progress. The standbys are updated one at a time from the highest ordinal down, each one only
+// after the previous one runs the new template and is ready. The primary, ordinal 0, is updated
+// last. Instances run a single pod without streaming replication, so there is no standby to
+// switch over to and the primary is restarted in place.
+func (r *PostgresReconciler) reconcileRollout(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet) (bool, error) {
+	partition := rolloutPartition(sts)
+	if partition == 0 {
+		return false, nil
+	}
+
+	var pod corev1.Pod
+	name := fmt.Sprintf("%s-%d", pg.Name, partition)
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: pg.Namespace}, &pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if pod.Labels[appsv1.ControllerRevisionHashLabelKey] != sts.Status.UpdateRevision || !podReady(&pod) {
+		log.FromContext(ctx).Info("Waiting for pod to be updated", "Pod.Name", pod.Name)
+		return true, nil
+	}
+
+	partition--
+	sts.Spec.UpdateStrategy.RollingUpdate.Partition = &partition
+	if err := r.Update(ctx, sts); err != nil {
+		return false, err
+	}
+	r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventRollingUpdate, "Pod %s is updated, updating pod %s-%d", pod.Name, pg.Name, partition)
+	return true, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Rolling updates", func() {
+	var (
+		pg  *postgresv1beta1.Postgres
+		sts *appsv1.StatefulSet
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		replicas := int32(3)
+		sts = newTestStatefulSet()
+		sts.Spec.Replicas = &replicas
+		sts.Status.UpdateRevision = "new"
+		startRollout(sts, corev1.PodTemplateSpec{})
+	})
+
+	pod := func(name, revision string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop",
+				Labels: map[string]string{appsv1.ControllerRevisionHashLabelKey: revision}},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+		}
+	}
+
+	reconciler := func(objs ...client.Object) *PostgresReconciler {
+		return newTestReconciler(append(objs, sts)...)
+	}
+
+	It("should start with the standby with the highest ordinal", func() {
+		Expect(rolloutPartition(sts)).To(Equal(int32(2)))
+	})
+
+	It("should wait until the updated standby is ready", func() {
+		r := reconciler(pod("orders-2", "new", corev1.ConditionFalse))
+		rolling, err := r.reconcileRollout(context.Background(), pg, sts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolling).To(BeTrue())
+		Expect(rolloutPartition(sts)).To(Equal(int32(2)))
+	})
+
+	It("should wait until the standby runs the new revision", func() {
+		r := reconciler(pod("orders-2", "old", corev1.ConditionTrue))
+		rolling, err := r.reconcileRollout(context.Background(), pg, sts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolling).To(BeTrue())
+		Expect(rolloutPartition(sts)).To(Equal(int32(2)))
+	})
+
+	It("should move on to the next pod once the standby is ready", func() {
+		r := reconciler(pod("orders-2", "new", corev1.ConditionTrue))
+		rolling, err := r.reconcileRollout(context.Background(), pg, sts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolling).To(BeTrue())
+		Expect(rolloutPartition(sts)).To(Equal(int32(1)))
+	})
+
+	It("should be done once the primary is released", func() {
+		partition := int32(0)
+		sts.Spec.UpdateStrategy.RollingUpdate.Partition = &partition
+		rolling, err := reconciler().reconcileRollout(context.Background(), pg, sts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolling).To(BeFalse())
+	})
+})
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// applyScheduling sets the node selector, tolerations, affinity, topology spread constraints and
+// priority class of spec.scheduling on spec. There is no default pod anti-affinity, instances run
+// a single pod.
+func applyScheduling(pg *postgresv1beta1.Postgres, spec *corev1.PodSpec) {
+	applyNodePlacement(pg, spec)
+	scheduling := pg.Spec.Scheduling
+	if scheduling == nil {
+		scheduling = &postgresv1beta1.Scheduling{}
+	}
+	scheduling = scheduling.DeepCopy()
+	spec.Affinity = scheduling.Affinity
+	spec.TopologySpreadConstraints = scheduling.TopologySpreadConstraints
+}
+
+// applyNodePlacement sets the node selector, tolerations, node affinity and priority class of
+// spec.scheduling on spec, for pods that run on the nodes of the instance without being its
+// pods, like the pooler. Pod affinities and topology spread constraints select the pods of the
+// instance, so they are left out.
+func applyNodePlacement(pg *postgresv1beta1.Postgres, spec *corev1.PodSpec) {
+	scheduling := pg.Spec.Scheduling
+	if scheduling == nil {
+		scheduling = &postgresv1beta1.Scheduling{}
+	}
+	scheduling = scheduling.DeepCopy()
+	spec.NodeSelector = scheduling.NodeSelector
+	spec.Tolerations = scheduling.Tolerations
+	spec.Affinity = nil
+	if scheduling.Affinity != nil && scheduling.Affinity.NodeAffinity != nil {
+		spec.Affinity = &corev1.Affinity{NodeAffinity: scheduling.Affinity.NodeAffinity}
+	}
+	spec.PriorityClassName = scheduling.PriorityClassName
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Scheduling", func() {
+	var pg *postgresv1beta1.Postgres
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Scheduling = &postgresv1beta1.Scheduling{
+			NodeSelector:      map[string]string{"pool": "databases"},
+			Tolerations:       []corev1.Toleration{{Key: "dedicated", Value: "databases", Effect: corev1.TaintEffectNoSchedule}},
+			PriorityClassName: "databases",
+			TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{
+				MaxSkew:           1,
+				TopologyKey:       corev1.LabelTopologyZone,
+				WhenUnsatisfiable: corev1.ScheduleAnyway,
+			}},
+		}
+	})
+
+	It("should place the pods as configured", func() {
+		spec := &corev1.PodSpec{}
+		applyScheduling(pg, spec)
+		Expect(spec.NodeSelector).To(Equal(map[string]string{"pool": "databases"}))
+		Expect(spec.Tolerations).To(HaveLen(1))
+		Expect(spec.TopologySpreadConstraints).To(HaveLen(1))
+		Expect(spec.PriorityClassName).To(Equal("databases"))
+		Expect(spec.Affinity).To(BeNil())
+	})
+
+	It("should apply a configured pod anti-affinity", func() {
+		required := &corev1.PodAntiAffinity{RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+			LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "orders"}},
+			TopologyKey:   corev1.LabelTopologyZone,
+		}}}
+		pg.Spec.Scheduling.Affinity = &corev1.Affinity{PodAntiAffinity: required}
+		spec := &corev1.PodSpec{}
+		applyScheduling(pg, spec)
+		Expect(spec.Affinity.PodAntiAffinity).To(Equal(required))
+	})
+})
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// postgresUID is the uid and gid of the postgres user in the official images
+	postgresUID = int64(999)
+
+	// dataMountPath is where the data volume is mounted
+	dataMountPath = "/var/lib/postgresql/data"
+	// pgdataPath is the data directory. It is a subdirectory of the volume, since a non-root
+	// initdb cannot take over the root of a volume owned by root.
+	pgdataPath = dataMountPath + "/pgdata"
+)
+
+// applyPodSecurity runs the pods of spec as the postgres user with the RuntimeDefault seccomp
+// profile, a read-only root filesystem and without capabilities, which passes the restricted Pod
+// Security Standard. With spec.security.runAsRoot the containers start as the image defines.
+func applyPodSecurity(pg *postgresv1beta1.Postgres, spec *corev1.PodSpec) {
+	gid := postgresUID
+	spec.SecurityContext = &corev1.PodSecurityContext{
+		// Lets the postgres user read the credentials and key files and write the data volume
+		FSGroup:        &gid,
+		SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+	if pg.Spec.Security.RunAsRoot {
+		return
+	}
+
+	uid := postgresUID
+	nonRoot := true
+	changePolicy := corev1.FSGroupChangeOnRootMismatch
+	spec.SecurityContext.RunAsUser = &uid
+	spec.SecurityContext.RunAsGroup = &gid
+	spec.SecurityContext.RunAsNonRoot = &nonRoot
+	spec.SecurityContext.FSGroupChangePolicy = &changePolicy
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].SecurityContext = restrictedSecurityContext()
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].SecurityContext = restrictedSecurityContext()
+	}
+}
+
+// restrictedSecurityContext returns the security context of a hardened container
+func restrictedSecurityContext() *corev1.SecurityContext {
+	escalation := false
+	readOnly := true
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &escalation,
+		ReadOnlyRootFilesystem:   &readOnly,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+	}
+}
+
+// scratchVolume returns an emptyDir volume for a path a read-only root filesystem must not cover
+func scratchVolume(name string) corev1.Volume {
+	return corev1.Volume{Name: name, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+}
+
+// pgdataLayoutScript moves a data directory at the root of the data volume, where earlier
+// versions of the operator kept it, to pgdataPath. PG_VERSION moves last, so an interrupted move
+// is continued on the next start.
+const pgdataLayoutScript = `
+if [ -f ` + dataMountPath + `/PG_VERSION ]; then
+  mkdir -p ` + pgdataPath + `
+  find ` + dataMountPath + ` -mindepth 1 -maxdepth 1 ! -name pgdata ! -name lost+found ! -name PG_VERSION -exec mv {} ` + pgdataPath + `/ \;
+  mv ` + dataMountPath + `/PG_VERSION ` + pgdataPath + `/
+  chmod 700 ` + pgdataPath + `
+fi
+`
+
+// asPostgresScript sets $as_postgres to the command running the rest of a line as the postgres
+// user, which is only needed when the container runs as root
+const asPostgresScript = `
+as_postgres=""
+if [ "$(id -u)" = 0 ]; then
+  as_postgres="gosu postgres"
+fi
+`
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Pod security", func() {
+	var (
+		pg   *postgresv1beta1.Postgres
+		spec *corev1.PodSpec
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		spec = &corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "pgdata"}},
+			Containers:     []corev1.Container{{Name: "postgresql"}, {Name: "exporter"}},
+		}
+	})
+
+	It("should run the pods as the postgres user with restricted containers", func() {
+		applyPodSecurity(pg, spec)
+		Expect(*spec.SecurityContext.RunAsNonRoot).To(BeTrue())
+		Expect(*spec.SecurityContext.RunAsUser).To(Equal(int64(999)))
+		Expect(*spec.SecurityContext.FSGroup).To(Equal(int64(999)))
+		Expect(spec.SecurityContext.SeccompProfile.Type).To(Equal(corev1.SeccompProfileTypeRuntimeDefault))
+		for _, container := range append(spec.InitContainers, spec.Containers...) {
+			Expect(*container.SecurityContext.AllowPrivilegeEscalation).To(BeFalse(), container.Name)
+			Expect(*container.SecurityContext.ReadOnlyRootFilesystem).To(BeTrue(), container.Name)
+			Expect(container.SecurityContext.Capabilities.Drop).To(Equal([]corev1.Capability{"ALL"}), container.Name)
+		}
+	})
+
+	It("should start the containers as the image defines with runAsRoot", func() {
+		pg.Spec.Security.RunAsRoot = true
+		applyPodSecurity(pg, spec)
+		Expect(spec.SecurityContext.RunAsUser).To(BeNil())
+		Expect(spec.SecurityContext.RunAsNonRoot).To(BeNil())
+		Expect(*spec.SecurityContext.FSGroup).To(Equal(int64(999)))
+		Expect(spec.Containers[0].SecurityContext).To(BeNil())
+	})
+
+	It("should only switch to the postgres user when running as root", func() {
+		Expect(postStartScript).NotTo(ContainSubstring("\ngosu"))
+		Expect(upgradeScript).To(ContainSubstring(`$as_postgres "$new_bin/pg_upgrade"`))
+		Expect(upgradeScript).To(ContainSubstring("data=" + pgdataPath))
+	})
+})
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// dataClaimName returns the name of the data volume claim of the i-th pod
+func dataClaimName(pg *postgresv1beta1.Postgres, i int32) string {
+	return fmt.Sprintf("data-%s-%d", pg.Name, i)
+}
+
+// dataClaimLabels returns the labels of the data volume claims of the instance
+func dataClaimLabels(pg *postgresv1beta1.Postgres) map[string]string {
+	return map[string]string{"app": pg.Name, postgresv1beta1.InstanceLabel: pg.Name}
+}
+
+// reconcileStorage reports in the StorageSize condition whether the data volumes of the instance
+// have the size of spec.storage.size. Volume claim templates of a StatefulSet are immutable and
+// the operator does not resize the claims, so a changed size is only reported. The warning Event
+// is only recorded when the condition turns false. Claims created from the templates of earlier
+// versions get the instance label, so deletion protection covers them.
+func (r *PostgresReconciler) reconcileStorage(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet) error {
+	desired, err := resource.ParseQuantity(pg.Spec.Storage.Size)
+	if err != nil {
+		return fmt.Errorf("invalid persistence size %q: %w", pg.Spec.Storage.Size, err)
+	}
+
+	var mismatched []string
+	for i := int32(0); i < *sts.Spec.Replicas; i++ {
+		var pvc corev1.PersistentVolumeClaim
+		if err := r.Get(ctx, types.NamespacedName{Name: dataClaimName(pg, i), Namespace: pg.Namespace}, &pvc); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if pvc.Labels[postgresv1beta1.InstanceLabel] != pg.Name {
+			if pvc.Labels == nil {
+				pvc.Labels = map[string]string{}
+			}
+			pvc.Labels[postgresv1beta1.InstanceLabel] = pg.Name
+			if err := r.Update(ctx, &pvc); err != nil {
+				return err
+			}
+		}
+		current := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if current.Cmp(desired) != 0 {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s", pvc.Name, current.String()))
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:               postgresv1beta1.ConditionStorageSize,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Matching",
+		Message:            fmt.Sprintf("All data volumes are %s", desired.String()),
+		ObservedGeneration: pg.Generation,
+	}
+	if len(mismatched) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = eventResizeRejected
+		condition.Message = fmt.Sprintf("Resizing the data volumes to %s is not supported: %s",
+			desired.String(), strings.Join(mismatched, ", "))
+	}
+	wasFalse := meta.IsStatusConditionFalse(pg.Status.Conditions, postgresv1beta1.ConditionStorageSize)
+	if !meta.SetStatusCondition(&pg.Status.Conditions, condition) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, pg); err != nil {
+		return err
+	}
+	if condition.Status == metav1.ConditionFalse && !wasFalse {
+		r.Recorder.Event(pg, corev1.EventTypeWarning, eventResizeRejected, condition.Message)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Storage", func() {
+	var (
+		pg       *postgresv1beta1.Postgres
+		sts      *appsv1.StatefulSet
+		r        *PostgresReconciler
+		recorder *record.FakeRecorder
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.Storage.Size = "10Gi"
+		sts = newTestStatefulSet()
+		claim := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data-orders-0", Namespace: "shop"},
+			Spec: corev1.PersistentVolumeClaimSpec{Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			}},
+		}
+		r = newTestReconciler(pg, claim)
+		recorder = r.Recorder.(*record.FakeRecorder)
+	})
+
+	It("should report volumes of the requested size", func() {
+		Expect(r.reconcileStorage(context.Background(), pg, sts)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(pg.Status.Conditions, postgresv1beta1.ConditionStorageSize)).To(BeTrue())
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("should warn once about a size the volumes do not have", func() {
+		pg.Spec.Storage.Size = "20Gi"
+		Expect(r.reconcileStorage(context.Background(), pg, sts)).To(Succeed())
+		condition := meta.FindStatusCondition(pg.Status.Conditions, postgresv1beta1.ConditionStorageSize)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Message).To(ContainSubstring("data-orders-0 is 10Gi"))
+		Expect(recorder.Events).To(Receive(ContainSubstring(eventResizeRejected)))
+
+		Expect(r.reconcileStorage(context.Background(), pg, sts)).To(Succeed())
+		Expect(recorder.Events).To(BeEmpty())
+
+		pg.Spec.Storage.Size = "10Gi"
+		Expect(r.reconcileStorage(context.Background(), pg, sts)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(pg.Status.Conditions, postgresv1beta1.ConditionStorageSize)).To(BeTrue())
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("should label the StatefulSet and its volume claims for deletion protection", func() {
+		pg.SetDefaults()
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: pg.Spec.Auth.SecretRef, Namespace: "shop"}}
+		desired := r.statefulSetForPostgres(pg, secret, r.configMapForPostgres(pg), nil, nil, "postgres:16")
+		Expect(desired.Labels).To(HaveKeyWithValue(postgresv1beta1.InstanceLabel, "orders"))
+		Expect(desired.Spec.VolumeClaimTemplates[0].Labels).To(Equal(dataClaimLabels(pg)))
+		Expect(desired.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "orders"}))
+
+		By("labelling the claims of earlier versions")
+		Expect(r.reconcileStorage(context.Background(), pg, sts)).To(Succeed())
+		var claim corev1.PersistentVolumeClaim
+		Expect(r.Get(context.Background(), types.NamespacedName{Name: "data-orders-0", Namespace: "shop"}, &claim)).To(Succeed())
+		Expect(claim.Labels).To(HaveKeyWithValue(postgresv1beta1.InstanceLabel, "orders"))
+	})
+})
@@ -0,0 +1,371 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// tlsMountPath is where the server certificate is mounted
+	tlsMountPath = "/etc/postgresql/tls"
+
+	// tlsHashAnnotation holds a hash of the certificate the pods were started with
+	tlsHashAnnotation = "postgres.snappcloud.io/tls-hash"
+
+	// clientCertificateLabel marks the client certificate Secrets issued by the operator
+	clientCertificateLabel = "postgres.snappcloud.io/client-certificate"
+
+	caCertificateValidity = 5 * 365 * 24 * time.Hour
+	certificateValidity   = 365 * 24 * time.Hour
+	// certificateRenewBefore is how long before expiry operator issued certificates are renewed
+	certificateRenewBefore = 30 * 24 * time.Hour
+
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+)
+
+// keyPair is a parsed certificate together with its private key
+type keyPair struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func caSecretName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-ca"
+}
+
+func serverTLSSecretName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-server-tls"
+}
+
+// tlsSecretName returns the name of the Secret holding the server certificate
+func tlsSecretName(pg *postgresv1beta1.Postgres) string {
+	if pg.Spec.TLS.Mode == postgresv1beta1.TLSModeSecretRef {
+		return pg.Spec.TLS.SecretRef
+	}
+	return serverTLSSecretName(pg)
+}
+
+// clientCertificateSecretName returns the Secret a client certificate is written to
+func clientCertificateSecretName(pg *postgresv1beta1.Postgres, cc postgresv1beta1.ClientCertificate) string {
+	if cc.SecretName != "" {
+		return cc.SecretName
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLower(r) || unicode.IsDigit(r) || r == '-' || r == '.' {
+			return r
+		}
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, cc.Role)
+	return pg.Name + "-client-" + name
+}
+
+// serverDNSNames returns the names clients may use to reach the instance, including those of the
+// Service postgres-service while the instance keeps it
+func serverDNSNames(pg *postgresv1beta1.Postgres, legacyService bool) []string {
+	services := []string{serviceName(pg)}
+	if legacyService {
+		services = append(services, legacyServiceName)
+	}
+	var names []string
+	for _, service := range services {
+		names = append(names,
+			service,
+			service+"."+pg.Namespace,
+			service+"."+pg.Namespace+".svc",
+			service+"."+pg.Namespace+".svc.cluster.local",
+			"*."+service+"."+pg.Namespace+".svc",
+			"*."+service+"."+pg.Namespace+".svc.cluster.local",
+		)
+	}
+	return append(names, "localhost")
+}
+
+// reconcileTLS ensures the server certificate Secret is present and valid. It returns the Secret
+// and, for operator issued certificates, the time the next renewal is due.
+func (r *PostgresReconciler) reconcileTLS(ctx context.Context, pg *postgresv1beta1.Postgres) (*corev1.Secret, time.Time, error) {
+	if pg.Spec.TLS.Mode == postgresv1beta1.TLSModeSecretRef {
+		if len(pg.Spec.TLS.ClientCertificates) > 0 {
+			return nil, time.Time{}, fmt.Errorf("client certificates require tls mode %s", postgresv1beta1.TLSModeOperator)
+		}
+		var secret corev1.Secret
+		if err := r.Get(ctx, types.NamespacedName{Name: pg.Spec.TLS.SecretRef, Namespace: pg.Namespace}, &secret); err != nil {
+			return nil, time.Time{}, err
+		}
+		if secret.Type != corev1.SecretTypeTLS {
+			return nil, time.Time{}, fmt.Errorf("secret %s is of type %s, not %s", secret.Name, secret.Type, corev1.SecretTypeTLS)
+		}
+		if len(secret.Data[corev1.TLSCertKey]) == 0 || len(secret.Data[corev1.TLSPrivateKeyKey]) == 0 {
+			return nil, time.Time{}, fmt.Errorf("secret %s does not contain %s and %s", secret.Name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+		return &secret, time.Time{}, nil
+	}
+
+	ca, err := r.ensureCA(ctx, pg)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	legacyService, err := r.ownedLegacyService(ctx, pg)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	dnsNames := serverDNSNames(pg, legacyService != nil && keepLegacyService(pg))
+	secret, server, err := r.ensureCertificate(ctx, pg, ca, serverTLSSecretName(pg), pg.Name, dnsNames, x509.ExtKeyUsageServerAuth, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	renewAt := server.cert.NotAfter.Add(-certificateRenewBefore)
+	if caRenewAt := ca.cert.NotAfter.Add(-certificateRenewBefore); caRenewAt.Before(renewAt) {
+		renewAt = caRenewAt
+	}
+
+	clientRenewAt, err := r.reconcileClientCertificates(ctx, pg, ca)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !clientRenewAt.IsZero() && clientRenewAt.Before(renewAt) {
+		renewAt = clientRenewAt
+	}
+	return secret, renewAt, nil
+}
+
+// reconcileClientCertificates issues the declared client certificates and removes the Secrets of
+// roles that are no longer declared. It returns when the first of them is due for renewal.
+func (r *PostgresReconciler) reconcileClientCertificates(ctx context.Context, pg *postgresv1beta1.Postgres, ca *keyPair) (time.Time, error) {
+	var renewAt time.Time
+	desired := map[string]bool{}
+	for _, cc := range pg.Spec.TLS.ClientCertificates {
+		name := clientCertificateSecretName(pg, cc)
+		desired[name] = true
+		_, issued, err := r.ensureCertificate(ctx, pg, ca, name, cc.Role, nil, x509.ExtKeyUsageClientAuth,
+			map[string]string{clientCertificateLabel: "true"})
+		if err != nil {
+			return time.Time{}, err
+		}
+		if at := issued.cert.NotAfter.Add(-certificateRenewBefore); renewAt.IsZero() || at.Before(renewAt) {
+			renewAt = at
+		}
+	}
+
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets,
+		client.InNamespace(pg.Namespace),
+		client.MatchingLabels{"app": pg.Name},
+		client.HasLabels{clientCertificateLabel},
+	); err != nil {
+		return time.Time{}, err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if desired[secret.Name] || !metav1.IsControlledBy(secret, pg) {
+			continue
+		}
+		log.FromContext(ctx).Info("Deleting client certificate Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		if err := r.Delete(ctx, secret); client.IgnoreNotFound(err) != nil {
+			return time.Time{}, err
+		}
+	}
+	return renewAt, nil
+}
+
+// ensureCA returns the instance CA, issuing a new one when it is missing or about to expire
+func (r *PostgresReconciler) ensureCA(ctx context.Context, pg *postgresv1beta1.Postgres) (*keyPair, error) {
+	logger := log.FromContext(ctx)
+
+	var secret corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Name: caSecretName(pg), Namespace: pg.Namespace}, &secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		ca, parseErr := parseKeyPair(secret.Data[caCertKey], secret.Data[caKeyKey])
+		if parseErr == nil && !needsRenewal(ca.cert) {
+			return ca, nil
+		}
+	}
+
+	ca, genErr := newKeyPair(nil, pg.Name+"-ca", nil, caCertificateValidity)
+	if genErr != nil {
+		return nil, genErr
+	}
+	data := map[string][]byte{
+		caCertKey: ca.certPEM,
+		caKeyKey:  ca.keyPEM,
+	}
+
+	if errors.IsNotFound(err) {
+		secret = corev1.Secret{
+			ObjectMeta: ctrl.ObjectMeta{
+				Name:      caSecretName(pg),
+				Namespace: pg.Namespace,
+				Labels:    map[string]string{"app": pg.Name},
+			},
+			Data: data,
+		}
+		if err := ctrl.SetControllerReference(pg, &secret, r.Scheme); err != nil {
+			return nil, err
+		}
+		logger.Info("Creating CA Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		return ca, r.Create(ctx, &secret)
+	}
+
+	logger.Info("Renewing CA", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+	secret.Data = data
+	return ca, r.Update(ctx, &secret)
+}
+
+// ensureCertificate makes sure the named kubernetes.io/tls Secret holds a certificate signed by ca
+// for the given names, reissuing it when it is missing, mismatched or about to expire.
+func (r *PostgresReconciler) ensureCertificate(ctx context.Context, pg *postgresv1beta1.Postgres, ca *keyPair,
+	name, commonName string, dnsNames []string, usage x509.ExtKeyUsage, labels map[string]string) (*corev1.Secret, *keyPair, error) {
+	logger := log.FromContext(ctx)
+
+	var secret corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: pg.Namespace}, &secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		current, parseErr := parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		if parseErr == nil && !needsRenewal(current.cert) &&
+			current.cert.CheckSignatureFrom(ca.cert) == nil &&
+			current.cert.Subject.CommonName == commonName &&
+			slices.Equal(current.cert.DNSNames, dnsNames) &&
+			bytes.Equal(secret.Data[caCertKey], ca.certPEM) {
+			return &secret, current, nil
+		}
+	}
+
+	issued, genErr := newKeyPair(ca, commonName, dnsNames, certificateValidity, usage)
+	if genErr != nil {
+		return nil, nil, genErr
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       issued.certPEM,
+		corev1.TLSPrivateKeyKey: issued.keyPEM,
+		caCertKey:               ca.certPEM,
+	}
+
+	if errors.IsNotFound(err) {
+		secret = corev1.Secret{
+			ObjectMeta: ctrl.ObjectMeta{
+				Name:      name,
+				Namespace: pg.Namespace,
+				Labels:    map[string]string{"app": pg.Name},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: data,
+		}
+		for key, value := range labels {
+			secret.Labels[key] = value
+		}
+		if err := ctrl.SetControllerReference(pg, &secret, r.Scheme); err != nil {
+			return nil, nil, err
+		}
+		logger.Info("Creating certificate Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		return &secret, issued, r.Create(ctx, &secret)
+	}
+
+	logger.Info("Renewing certificate", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+	secret.Data = data
+	return &secret, issued, r.Update(ctx, &secret)
+}
+
+// needsRenewal reports whether cert expires within the renewal window
+func needsRenewal(cert *x509.Certificate) bool {
+	return time.Now().Add(certificateRenewBefore).After(cert.NotAfter)
+}
+
+// newKeyPair issues a certificate signed by ca, or a self-signed CA when ca is nil
+func newKeyPair(ca *keyPair, commonName string, dnsNames []string, validity time.Duration, usages ...x509.ExtKeyUsage) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  usages,
+	}
+
+	parent, signer := template, crypto.Signer(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+// parseKeyPair decodes a PEM encoded certificate and EC private key
+func parseKeyPair(certPEM, keyPEM []byte) (*keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
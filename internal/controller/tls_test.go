@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("TLS certificates", func() {
+	It("should issue server certificates signed by the instance CA", func() {
+		ca, err := newKeyPair(nil, "test-ca", nil, caCertificateValidity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ca.cert.IsCA).To(BeTrue())
+
+		dnsNames := []string{"postgres-service", "postgres-service.default.svc"}
+		server, err := newKeyPair(ca, "test", dnsNames, certificateValidity, x509.ExtKeyUsageServerAuth)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.cert.CheckSignatureFrom(ca.cert)).To(Succeed())
+		Expect(server.cert.DNSNames).To(Equal(dnsNames))
+		Expect(server.cert.VerifyHostname("postgres-service.default.svc")).To(Succeed())
+
+		parsed, err := parseKeyPair(server.certPEM, server.keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.cert.SerialNumber).To(Equal(server.cert.SerialNumber))
+	})
+
+	It("should renew certificates close to expiry", func() {
+		fresh, err := newKeyPair(nil, "fresh", nil, certificateValidity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(needsRenewal(fresh.cert)).To(BeFalse())
+
+		expiring, err := newKeyPair(nil, "expiring", nil, certificateRenewBefore-time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(needsRenewal(expiring.cert)).To(BeTrue())
+	})
+
+	It("should name the Service of the instance in the server certificate", func() {
+		dnsNames := serverDNSNames(newTestPostgres(), false)
+		Expect(dnsNames).To(ContainElements("orders", "orders.shop.svc", "orders.shop.svc.cluster.local", "localhost"))
+		Expect(dnsNames).NotTo(ContainElement(ContainSubstring(legacyServiceName)))
+
+		By("keeping the names of the legacy Service while the instance keeps it")
+		dnsNames = serverDNSNames(newTestPostgres(), true)
+		Expect(dnsNames).To(ContainElements("orders.shop.svc", "postgres-service", "postgres-service.shop.svc", "*.postgres-service.shop.svc"))
+	})
+})
+
+var _ = Describe("TLS Secrets", func() {
+	var (
+		pg *postgresv1beta1.Postgres
+		r  *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.TLS = &postgresv1beta1.TLS{Mode: postgresv1beta1.TLSModeOperator}
+		r = newTestReconciler(pg)
+	})
+
+	getSecret := func(name string) *corev1.Secret {
+		var secret corev1.Secret
+		Expect(r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "shop"}, &secret)).To(Succeed())
+		return &secret
+	}
+
+	// parse returns the certificate and CA a Secret holds
+	parse := func(secret *corev1.Secret, certKey, keyKey string) *keyPair {
+		pair, err := parseKeyPair(secret.Data[certKey], secret.Data[keyKey])
+		Expect(err).NotTo(HaveOccurred())
+		return pair
+	}
+
+	// storeServerCertificate replaces the server certificate by one issued by the instance CA
+	storeServerCertificate := func(dnsNames []string, validity time.Duration) {
+		ca := parse(getSecret("orders-ca"), caCertKey, caKeyKey)
+		issued, err := newKeyPair(ca, "orders", dnsNames, validity, x509.ExtKeyUsageServerAuth)
+		Expect(err).NotTo(HaveOccurred())
+		secret := getSecret("orders-server-tls")
+		secret.Data[corev1.TLSCertKey] = issued.certPEM
+		secret.Data[corev1.TLSPrivateKeyKey] = issued.keyPEM
+		Expect(r.Update(context.Background(), secret)).To(Succeed())
+	}
+
+	It("should issue the CA and the server certificate once", func() {
+		secret, renewAt, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Name).To(Equal("orders-server-tls"))
+		Expect(secret.Type).To(Equal(corev1.SecretTypeTLS))
+		Expect(metav1.IsControlledBy(secret, pg)).To(BeTrue())
+
+		caSecret := getSecret("orders-ca")
+		Expect(metav1.IsControlledBy(caSecret, pg)).To(BeTrue())
+		ca := parse(caSecret, caCertKey, caKeyKey)
+		Expect(ca.cert.IsCA).To(BeTrue())
+
+		server := parse(getSecret("orders-server-tls"), corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		Expect(server.cert.CheckSignatureFrom(ca.cert)).To(Succeed())
+		Expect(server.cert.Subject.CommonName).To(Equal("orders"))
+		Expect(server.cert.DNSNames).To(Equal(serverDNSNames(pg, false)))
+		Expect(server.cert.ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}))
+		Expect(getSecret("orders-server-tls").Data[caCertKey]).To(Equal(caSecret.Data[caCertKey]))
+		Expect(renewAt).To(BeTemporally("~", server.cert.NotAfter.Add(-certificateRenewBefore), time.Second))
+
+		By("keeping both on the next reconcile")
+		again, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.Data).To(Equal(secret.Data))
+		Expect(getSecret("orders-ca").Data).To(Equal(caSecret.Data))
+	})
+
+	It("should reissue the server certificate when its names do not match", func() {
+		_, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		storeServerCertificate([]string{"postgres-service.shop.svc"}, certificateValidity)
+
+		_, _, err = r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		server := parse(getSecret("orders-server-tls"), corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		Expect(server.cert.DNSNames).To(Equal(serverDNSNames(pg, false)))
+	})
+
+	It("should renew the server certificate close to expiry", func() {
+		_, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		storeServerCertificate(serverDNSNames(pg, false), certificateRenewBefore-time.Hour)
+		expiring := parse(getSecret("orders-server-tls"), corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+
+		_, renewAt, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		server := parse(getSecret("orders-server-tls"), corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		Expect(server.cert.SerialNumber).NotTo(Equal(expiring.cert.SerialNumber))
+		Expect(needsRenewal(server.cert)).To(BeFalse())
+		Expect(renewAt).To(BeTemporally(">", time.Now()))
+	})
+
+	It("should restart the pods when the certificate changes", func() {
+		pg.SetDefaults()
+		credentials := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: pg.Spec.Auth.SecretRef, Namespace: "shop"}}
+		podAnnotations := func() map[string]string {
+			tlsSecret, _, err := r.reconcileTLS(context.Background(), pg)
+			Expect(err).NotTo(HaveOccurred())
+			return r.statefulSetForPostgres(pg, credentials, r.configMapForPostgres(pg), tlsSecret, nil, "postgres:16").Spec.Template.Annotations
+		}
+		before := podAnnotations()
+		Expect(before).To(HaveKey(tlsHashAnnotation))
+		Expect(podAnnotations()[tlsHashAnnotation]).To(Equal(before[tlsHashAnnotation]))
+
+		storeServerCertificate(serverDNSNames(pg, false), certificateRenewBefore-time.Hour)
+		Expect(podAnnotations()[tlsHashAnnotation]).NotTo(Equal(before[tlsHashAnnotation]))
+	})
+
+	Context("with a user supplied Secret", func() {
+		BeforeEach(func() {
+			pg.Spec.TLS = &postgresv1beta1.TLS{Mode: postgresv1beta1.TLSModeSecretRef, SecretRef: "orders-tls"}
+		})
+
+		userSecret := func(secretType corev1.SecretType) *corev1.Secret {
+			ca, err := newKeyPair(nil, "team-ca", nil, caCertificateValidity)
+			Expect(err).NotTo(HaveOccurred())
+			issued, err := newKeyPair(ca, "orders", []string{"orders.shop.svc"}, certificateValidity, x509.ExtKeyUsageServerAuth)
+			Expect(err).NotTo(HaveOccurred())
+			return &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "orders-tls", Namespace: "shop"},
+				Type:       secretType,
+				Data:       map[string][]byte{corev1.TLSCertKey: issued.certPEM, corev1.TLSPrivateKeyKey: issued.keyPEM},
+			}
+		}
+
+		It("should use it as it is without issuing anything", func() {
+			supplied := userSecret(corev1.SecretTypeTLS)
+			r = newTestReconciler(pg, supplied)
+			secret, renewAt, err := r.reconcileTLS(context.Background(), pg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Data).To(Equal(supplied.Data))
+			Expect(renewAt).To(BeZero())
+			err = r.Get(context.Background(), types.NamespacedName{Name: "orders-ca", Namespace: "shop"}, &corev1.Secret{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should fail while the Secret is missing", func() {
+			_, _, err := r.reconcileTLS(context.Background(), pg)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should reject a Secret that is not a TLS Secret", func() {
+			r = newTestReconciler(pg, userSecret(corev1.SecretTypeOpaque))
+			_, _, err := r.reconcileTLS(context.Background(), pg)
+			Expect(err).To(MatchError(ContainSubstring("not kubernetes.io/tls")))
+		})
+
+		It("should reject a Secret without a key", func() {
+			supplied := userSecret(corev1.SecretTypeTLS)
+			delete(supplied.Data, corev1.TLSPrivateKeyKey)
+			r = newTestReconciler(pg, supplied)
+			_, _, err := r.reconcileTLS(context.Background(), pg)
+			Expect(err).To(MatchError(ContainSubstring("does not contain")))
+		})
+	})
+})
+
+var _ = Describe("Client certificates", func() {
+	var (
+		pg *postgresv1beta1.Postgres
+		r  *PostgresReconciler
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.TLS = &postgresv1beta1.TLS{
+			Mode: postgresv1beta1.TLSModeOperator,
+			ClientCertificates: []postgresv1beta1.ClientCertificate{
+				{Role: "billing"},
+				{Role: "Reporting_Jobs", SecretName: "reporting-client"},
+			},
+		}
+		r = newTestReconciler(pg)
+	})
+
+	getSecret := func(name string) (*corev1.Secret, error) {
+		var secret corev1.Secret
+		err := r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "shop"}, &secret)
+		return &secret, err
+	}
+
+	getPair := func(name, certKey, keyKey string) *keyPair {
+		secret, err := getSecret(name)
+		Expect(err).NotTo(HaveOccurred())
+		pair, err := parseKeyPair(secret.Data[certKey], secret.Data[keyKey])
+		Expect(err).NotTo(HaveOccurred())
+		return pair
+	}
+
+	It("should issue a certificate for each role signed by the instance CA", func() {
+		_, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		ca := getPair("orders-ca", caCertKey, caKeyKey)
+
+		for name, role := range map[string]string{"orders-client-billing": "billing", "reporting-client": "Reporting_Jobs"} {
+			secret, err := getSecret(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Type).To(Equal(corev1.SecretTypeTLS))
+			Expect(secret.Labels).To(HaveKeyWithValue(clientCertificateLabel, "true"))
+			Expect(metav1.IsControlledBy(secret, pg)).To(BeTrue())
+			Expect(secret.Data[caCertKey]).To(Equal(ca.certPEM))
+
+			client := getPair(name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+			Expect(client.cert.CheckSignatureFrom(ca.cert)).To(Succeed())
+			Expect(client.cert.Subject.CommonName).To(Equal(role))
+			Expect(client.cert.DNSNames).To(BeEmpty())
+			Expect(client.cert.ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}))
+		}
+	})
+
+	It("should reissue the certificates when the CA is rotated", func() {
+		_, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		before := getPair("orders-client-billing", corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+
+		expiring, err := newKeyPair(nil, "orders-ca", nil, certificateRenewBefore-time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		caSecret, err := getSecret("orders-ca")
+		Expect(err).NotTo(HaveOccurred())
+		caSecret.Data = map[string][]byte{caCertKey: expiring.certPEM, caKeyKey: expiring.keyPEM}
+		Expect(r.Update(context.Background(), caSecret)).To(Succeed())
+
+		_, _, err = r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		ca := getPair("orders-ca", caCertKey, caKeyKey)
+		Expect(ca.cert.SerialNumber).NotTo(Equal(expiring.cert.SerialNumber))
+		after := getPair("orders-client-billing", corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		Expect(after.cert.SerialNumber).NotTo(Equal(before.cert.SerialNumber))
+		Expect(after.cert.CheckSignatureFrom(ca.cert)).To(Succeed())
+	})
+
+	It("should delete the Secrets of roles that are no longer declared", func() {
+		_, _, err := r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		foreign := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name: "orders-client-manual", Namespace: "shop",
+			Labels: map[string]string{"app": "orders", clientCertificateLabel: "true"},
+		}}
+		Expect(r.Create(context.Background(), foreign)).To(Succeed())
+
+		pg.Spec.TLS.ClientCertificates = pg.Spec.TLS.ClientCertificates[:1]
+		_, _, err = r.reconcileTLS(context.Background(), pg)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = getSecret("reporting-client")
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		_, err = getSecret("orders-client-billing")
+		Expect(err).NotTo(HaveOccurred())
+
+		By("leaving Secrets the instance does not own alone")
+		_, err = getSecret("orders-client-manual")
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
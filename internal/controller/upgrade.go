@@ -0,0 +1,456 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+const (
+	// upgradePollInterval is how often an upgrade step checks on the objects it waits for
+	upgradePollInterval = 10 * time.Second
+
+	// upgradeStartTimeout is how long the new version may take to become ready after pg_upgrade
+	// before the upgrade is rolled back
+	upgradeStartTimeout = 10 * time.Minute
+
+	// DefaultUpgradeImage is the image running pg_upgrade, it ships the binaries of both versions.
+	// {from} and {to} are replaced by the major versions.
+	DefaultUpgradeImage = "tianon/postgres-upgrade:{from}-to-{to}"
+)
+
+func upgradeJobName(pg *postgresv1beta1.Postgres) string {
+	return pg.Name + "-upgrade"
+}
+
+// preUpgradeSnapshotName returns the name of the VolumeSnapshot taken of a data volume before an upgrade
+func preUpgradeSnapshotName(pg *postgresv1beta1.Postgres, claim string) string {
+	return fmt.Sprintf("%s-upgrade-%d", claim, pg.Status.Upgrade.StartTime.Unix())
+}
+
+// postgresVersion returns the version the pods run. When the major version changed it stays at the
+// running version until pg_upgrade converted the data directory, and after a rollback until the
+// upgrade is retried with another version.
+func postgresVersion(pg *postgresv1beta1.Postgres) string {
+	version := pg.Spec.PostgreSQL.Version
+	if pg.Status.Version == "" || postgresv1beta1.MajorVersion(pg.Status.Version) == postgresv1beta1.MajorVersion(version) {
+		return version
+	}
+	if upgrade := pg.Status.Upgrade; upgrade != nil && upgrade.ToVersion == version {
+		switch upgrade.Step {
+		case postgresv1beta1.UpgradeStepStarting, postgresv1beta1.UpgradeStepAnalyzing, postgresv1beta1.UpgradeStepPromoting,
+			postgresv1beta1.UpgradeStepCompleted:
+			return version
+		}
+	}
+	return pg.Status.Version
+}
+
+// reconcileUpgrade runs one step of a major version upgrade and returns the delay after which it
+// wants to be called again, or zero when no upgrade is in progress. While it runs it owns the
+// StatefulSet and the rest of the reconciliation waits.
+//
+// The steps are: snapshot the data volumes, scale the instance down, run pg_upgrade --link in a
+// Job, start the new version and ANALYZE every database. When pg_upgrade fails or the new version
+// does not become ready within upgradeStartTimeout, the data volumes are restored from the
+// snapshots and the old version is started again. Instances run a single pod, so there are no
+// standbys to rebuild afterwards.
+//
+// Blue/green upgrades run from reconcileBlueGreen, only their Promoting step runs here.
+func (r *PostgresReconciler) reconcileUpgrade(ctx context.Context, pg *postgresv1beta1.Postgres, sts, desired *appsv1.StatefulSet,
+	secret *corev1.Secret) (time.Duration, error) {
+	upgrade := pg.Status.Upgrade
+	if !upgrade.InProgress() {
+		from, to := pg.Status.Version, pg.Spec.PostgreSQL.Version
+		if from == "" || postgresv1beta1.MajorVersion(to) <= postgresv1beta1.MajorVersion(from) {
+			return 0, nil
+		}
+		if upgrade != nil && upgrade.Step == postgresv1beta1.UpgradeStepRolledBack && upgrade.ToVersion == to {
+			return 0, nil
+		}
+		strategy := upgradeStrategy(pg)
+		if strategy == postgresv1beta1.UpgradeStrategyBlueGreen && sts.Annotations[templateHashAnnotation] != desired.Annotations[templateHashAnnotation] {
+			// Restart with wal_level=logical first
+			return 0, nil
+		}
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventUpgrading, "Upgrading from version %s to %s with strategy %s", from, to, strategy)
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: from, ToVersion: to, Strategy: strategy, StartTime: metav1.Now()}
+		if strategy == postgresv1beta1.UpgradeStrategyBlueGreen {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepProvisioning, "")
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepSnapshotting, "")
+	}
+	if upgrade.Strategy == postgresv1beta1.UpgradeStrategyBlueGreen {
+		if upgrade.Step != postgresv1beta1.UpgradeStepPromoting {
+			return 0, nil
+		}
+		return r.promoteGreen(ctx, pg, sts, desired)
+	}
+
+	logger := log.FromContext(ctx)
+	switch upgrade.Step {
+	case postgresv1beta1.UpgradeStepSnapshotting:
+		claims, err := r.dataClaims(ctx, pg)
+		if err != nil {
+			return 0, err
+		}
+		ready, err := r.ensureSnapshots(ctx, pg, claims, func(claim string) string { return preUpgradeSnapshotName(pg, claim) })
+		if meta.IsNoMatchError(err) {
+			// Nothing changed yet, so there is nothing to restore
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRolledBack, "the data volumes cannot be snapshotted, the VolumeSnapshot CRDs are not installed")
+		} else if err != nil {
+			return 0, err
+		}
+		if !ready {
+			return upgradePollInterval, nil
+		}
+		now := metav1.Now()
+		pg.Status.LastSuccessfulBackup = &now
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepStopping, "")
+
+	case postgresv1beta1.UpgradeStepStopping:
+		// The Job of a previous attempt is kept for its logs until now
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: upgradeJobName(pg), Namespace: pg.Namespace}}
+		if err := r.deleteOwned(ctx, pg, job); err != nil {
+			return 0, err
+		}
+		if stopped, err := r.stopInstance(ctx, pg, sts); err != nil || !stopped {
+			return upgradePollInterval, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepUpgrading, "")
+
+	case postgresv1beta1.UpgradeStepUpgrading:
+		var job batchv1.Job
+		err := r.Get(ctx, types.NamespacedName{Name: upgradeJobName(pg), Namespace: pg.Namespace}, &job)
+		if apierrors.IsNotFound(err) {
+			job := jobForUpgrade(pg, sts, r.upgradeImage(pg))
+			// The Job mounts the data volume, so it must be able to run where the instance runs
+			applyScheduling(pg, &job.Spec.Template.Spec)
+			applyPodSecurity(pg, &job.Spec.Template.Spec)
+			r.applyImageSettings(pg, &job.Spec.Template.Spec)
+			if err := ctrl.SetControllerReference(pg, job, r.Scheme); err != nil {
+				return 0, err
+			}
+			logger.Info("Creating upgrade Job", "Job.Name", job.Name)
+			if err := r.Create(ctx, job); err != nil {
+				return 0, err
+			}
+			return upgradePollInterval, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if job.Status.Succeeded > 0 {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepStarting, "")
+		}
+		if job.Status.Failed > 0 {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRollingBack, fmt.Sprintf("pg_upgrade failed, see the logs of Job %s", job.Name))
+		}
+		return upgradePollInterval, nil
+
+	case postgresv1beta1.UpgradeStepStarting:
+		if *sts.Spec.Replicas == 0 {
+			startUpgraded(sts, desired)
+			if err := r.Update(ctx, sts); err != nil {
+				return 0, err
+			}
+			return upgradePollInterval, nil
+		}
+		if sts.Status.ObservedGeneration == sts.Generation && sts.Status.ReadyReplicas == *sts.Spec.Replicas {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepAnalyzing, "")
+		}
+		if time.Since(upgrade.StepTime.Time) > upgradeStartTimeout {
+			return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRollingBack,
+				fmt.Sprintf("version %s did not become ready within %s", upgrade.ToVersion, upgradeStartTimeout))
+		}
+		return upgradePollInterval, nil
+
+	case postgresv1beta1.UpgradeStepAnalyzing:
+		if err := analyzeDatabases(ctx, pg, secret); err != nil {
+			return 0, err
+		}
+		pg.Status.Version = upgrade.ToVersion
+		r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventUpdated, "Upgraded from version %s to %s", upgrade.FromVersion, upgrade.ToVersion)
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepCompleted, "")
+
+	case postgresv1beta1.UpgradeStepRollingBack:
+		// The new version may be running when it did not become ready
+		if stopped, err := r.stopInstance(ctx, pg, sts); err != nil || !stopped {
+			return upgradePollInterval, err
+		}
+		restored := true
+		for i := int32(0); i < *desired.Spec.Replicas; i++ {
+			done, err := r.restoreClaim(ctx, pg, sts, dataClaimName(pg, i))
+			if err != nil {
+				return 0, err
+			}
+			restored = restored && done
+		}
+		if !restored {
+			return upgradePollInterval, nil
+		}
+		// desired is built for the old version while the upgrade is not past pg_upgrade
+		startUpgraded(sts, desired)
+		if err := r.Update(ctx, sts); err != nil {
+			return 0, err
+		}
+		return r.setUpgradeStep(ctx, pg, postgresv1beta1.UpgradeStepRolledBack, upgrade.Message)
+	}
+	return 0, nil
+}
+
+// stopInstance scales the StatefulSet down and reports whether all its pods are gone
+func (r *PostgresReconciler) stopInstance(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet) (bool, error) {
+	if *sts.Spec.Replicas != 0 {
+		replicas := int32(0)
+		sts.Spec.Replicas = &replicas
+		if err := r.Update(ctx, sts); err != nil {
+			return false, err
+		}
+	}
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels{"app": pg.Name}); err != nil {
+		return false, err
+	}
+	if len(pods.Items) > 0 {
+		log.FromContext(ctx).Info("Waiting for pods to terminate", "Pods", len(pods.Items))
+		return false, nil
+	}
+	return true, nil
+}
+
+// setUpgradeStep records the next upgrade step in the status and asks to be called again right away
+func (r *PostgresReconciler) setUpgradeStep(ctx context.Context, pg *postgresv1beta1.Postgres, step postgresv1beta1.UpgradeStep, message string) (time.Duration, error) {
+	if pg.Status.Upgrade.Step != step {
+		pg.Status.Upgrade.StepTime = metav1.Now()
+	}
+	pg.Status.Upgrade.Step = step
+	if message != "" {
+		pg.Status.Upgrade.Message = message
+	}
+	// A blue/green upgrade keeps serving until the volume of the new instance is moved over
+	if pg.Status.Upgrade.InProgress() && (pg.Status.Upgrade.Strategy != postgresv1beta1.UpgradeStrategyBlueGreen ||
+		step == postgresv1beta1.UpgradeStepPromoting) {
+		pg.Status.Ready = false
+		pg.Status.Phase = postgresv1beta1.PostgresPhaseUpgrading
+		// The primary pod is replaced on purpose, this is not a failover
+		pg.Status.CurrentPrimaryUID = ""
+		meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
+			Type:               postgresv1beta1.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             string(postgresv1beta1.PostgresPhaseUpgrading),
+			Message:            fmt.Sprintf("Upgrade to version %s: %s", pg.Status.Upgrade.ToVersion, step),
+			ObservedGeneration: pg.Generation,
+		})
+	}
+	if step == postgresv1beta1.UpgradeStepRolledBack {
+		r.Recorder.Eventf(pg, corev1.EventTypeWarning, eventUpgradeFailed, "Upgrade to version %s rolled back to %s: %s",
+			pg.Status.Upgrade.ToVersion, pg.Status.Upgrade.FromVersion, message)
+	}
+	if err := r.Status().Update(ctx, pg); err != nil {
+		return 0, err
+	}
+	return time.Second, nil
+}
+
+// startUpgraded scales the StatefulSet back up with the template of desired, all pods at once
+func startUpgraded(sts, desired *appsv1.StatefulSet) {
+	if sts.Annotations == nil {
+		sts.Annotations = map[string]string{}
+	}
+	sts.Annotations[templateHashAnnotation] = desired.Annotations[templateHashAnnotation]
+	sts.Spec.Replicas = desired.Spec.Replicas
+	sts.Spec.Template = desired.Spec.Template
+	sts.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+}
+
+// restoreClaim replaces a data volume claim by one restored from its pre-upgrade snapshot and
+// reports whether the restored claim exists
+func (r *PostgresReconciler) restoreClaim(ctx context.Context, pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet, name string) (bool, error) {
+	snapshot := preUpgradeSnapshotName(pg, name)
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: pg.Namespace}, &pvc)
+	if err == nil {
+		if source := pvc.Spec.DataSource; source != nil && source.Kind == volumeSnapshotGVK.Kind && source.Name == snapshot {
+			return true, nil
+		}
+		if pvc.DeletionTimestamp.IsZero() {
+			r.Recorder.Eventf(pg, corev1.EventTypeNormal, eventDeleting, "Deleting volume %s to restore it from VolumeSnapshot %s", name, snapshot)
+			if err := r.Delete(ctx, &pvc); client.IgnoreNotFound(err) != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	group := volumeSnapshotGVK.Group
+	pvc = corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace, Labels: dataClaimLabels(pg)},
+		Spec:       *sts.Spec.VolumeClaimTemplates[0].Spec.DeepCopy(),
+	}
+	pvc.Spec.DataSource = &corev1.TypedLocalObjectReference{APIGroup: &group, Kind: volumeSnapshotGVK.Kind, Name: snapshot}
+	if err := r.Create(ctx, &pvc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// analyzeDatabases collects planner statistics in every database, pg_upgrade does not carry them over
+func analyzeDatabases(ctx context.Context, pg *postgresv1beta1.Postgres, secret *corev1.Secret) error {
+	db, err := openDatabase(pg, secret, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names, err := queryStrings(ctx, db, "SELECT datname FROM pg_database WHERE datallowconn")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		conn, err := openDatabase(pg, secret, name)
+		if err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, "ANALYZE")
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("analyzing database %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Helper function jobForUpgrade returns the Job running pg_upgrade in image on the data volume of the primary
+func jobForUpgrade(pg *postgresv1beta1.Postgres, sts *appsv1.StatefulSet, image string) *batchv1.Job {
+	backoffLimit := int32(0)
+	from := postgresv1beta1.MajorVersion(pg.Status.Upgrade.FromVersion)
+	to := postgresv1beta1.MajorVersion(pg.Status.Upgrade.ToVersion)
+
+	var credentials corev1.Volume
+	for _, volume := range sts.Spec.Template.Spec.Volumes {
+		if volume.Name == "credentials" {
+			credentials = volume
+		}
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      upgradeJobName(pg),
+			Namespace: pg.Namespace,
+			Labels:    map[string]string{"app": pg.Name + "-upgrade"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": pg.Name + "-upgrade"},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "pg-upgrade",
+						Image:   image,
+						Command: []string{"/bin/sh", "-c", upgradeScript},
+						Env: []corev1.EnvVar{
+							{Name: "OLD_MAJOR", Value: fmt.Sprint(from)},
+							{Name: "NEW_MAJOR", Value: fmt.Sprint(to)},
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "data",
+								MountPath: dataMountPath,
+							},
+							{
+								Name:      "tmp",
+								MountPath: "/tmp",
+							},
+							{
+								Name:      "credentials",
+								MountPath: credentialsMountPath,
+								ReadOnly:  true,
+							},
+						},
+					}},
+					Volumes: []corev1.Volume{
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: dataClaimName(pg, 0)},
+							},
+						},
+						credentials,
+						scratchVolume("tmp"),
+					},
+				},
+			},
+		},
+	}
+}
+
+// upgradeImage returns the image running pg_upgrade from spec.postgresql.upgradeImage, the
+// --upgrade-image of the operator or DefaultUpgradeImage
+func (r *PostgresReconciler) upgradeImage(pg *postgresv1beta1.Postgres) string {
+	image := pg.Spec.PostgreSQL.UpgradeImage
+	if image == "" {
+		image = r.UpgradeImage
+	}
+	if image == "" {
+		image = DefaultUpgradeImage
+	}
+	return strings.NewReplacer(
+		"{from}", fmt.Sprint(postgresv1beta1.MajorVersion(pg.Status.Upgrade.FromVersion)),
+		"{to}", fmt.Sprint(postgresv1beta1.MajorVersion(pg.Status.Upgrade.ToVersion)),
+	).Replace(image)
+}
+
+// upgradeScript moves the old cluster aside, initializes the new one with the same superuser and
+// checksum setting, upgrades with hard links and moves the new cluster into place. A failure at
+// any point is recovered by restoring the volume from its pre-upgrade snapshot.
+const upgradeScript = `
+set -eu` + pgdataLayoutScript + asPostgresScript + `
+user="$(cat ` + credentialsMountPath + `/username)"
+data=` + pgdataPath + `
+old_bin="/usr/lib/postgresql/$OLD_MAJOR/bin"
+new_bin="/usr/lib/postgresql/$NEW_MAJOR/bin"
+mkdir "$data/old" "$data/new"
+find "$data" -mindepth 1 -maxdepth 1 ! -name old ! -name new ! -name lost+found -exec mv {} "$data/old/" \;
+if [ "$(id -u)" = 0 ]; then
+  chown postgres:postgres "$data" "$data/old" "$data/new"
+fi
+chmod 700 "$data/old" "$data/new"
+
+checksums=""
+if [ "$("$old_bin/pg_controldata" "$data/old" | sed -n 's/^Data page checksum version: *//p')" != 0 ]; then
+  checksums="--data-checksums"
+elif [ "$NEW_MAJOR" -ge 18 ]; then
+  checksums="--no-data-checksums"
+fi
+$as_postgres "$new_bin/initdb" --username="$user" $checksums -D "$data/new"
+cp "$data/old/pg_hba.conf" "$data/new/pg_hba.conf"
+echo "listen_addresses = '*'" >> "$data/new/postgresql.conf"
+
+# pg_upgrade writes its logs and scripts to the working directory
+cd /tmp
+$as_postgres "$new_bin/pg_upgrade" --username="$user" --link \
+  --old-bindir="$old_bin" --new-bindir="$new_bin" --old-datadir="$data/old" --new-datadir="$data/new"
+rm -rf "$data/old"
+mv "$data"/new/* "$data/"
+rmdir "$data/new"
+`
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+var _ = Describe("Major version upgrades", func() {
+	var (
+		pg  *postgresv1beta1.Postgres
+		sts *appsv1.StatefulSet
+	)
+
+	BeforeEach(func() {
+		pg = newTestPostgres()
+		pg.Spec.PostgreSQL.Version = "16"
+		pg.Status.Version = "13"
+		sts = newTestStatefulSet()
+	})
+
+	reconciler := func(objs ...client.Object) *PostgresReconciler {
+		return newTestReconciler(append(objs, pg, sts)...)
+	}
+
+	It("should keep running the old version until pg_upgrade ran", func() {
+		Expect(postgresVersion(pg)).To(Equal("13"))
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepUpgrading}
+		Expect(postgresVersion(pg)).To(Equal("13"))
+		pg.Status.Upgrade.Step = postgresv1beta1.UpgradeStepStarting
+		Expect(postgresVersion(pg)).To(Equal("16"))
+		pg.Status.Upgrade.Step = postgresv1beta1.UpgradeStepRolledBack
+		Expect(postgresVersion(pg)).To(Equal("13"))
+	})
+
+	It("should apply minor version changes directly", func() {
+		pg.Spec.PostgreSQL.Version = "13.4"
+		Expect(postgresVersion(pg)).To(Equal("13.4"))
+	})
+
+	It("should start with snapshotting the data volumes", func() {
+		r := reconciler()
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepSnapshotting))
+		Expect(pg.Status.Phase).To(Equal(postgresv1beta1.PostgresPhaseUpgrading))
+	})
+
+	It("should record the snapshots as the latest backup once they are ready", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepSnapshotting,
+			StartTime: metav1.Now()}
+		claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name: "data-orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"},
+		}}
+		r := newTestReconciler()
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(volumeSnapshotGVK, meta.RESTScopeNamespace)
+		r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).
+			WithStatusSubresource(pg).WithObjects(pg, sts, claim).Build()
+
+		requeueAfter, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(upgradePollInterval))
+		Expect(pg.Status.LastSuccessfulBackup).To(BeNil())
+
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		key := types.NamespacedName{Name: preUpgradeSnapshotName(pg, "data-orders-0"), Namespace: "shop"}
+		Expect(r.Get(context.Background(), key, snapshot)).To(Succeed())
+		Expect(unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse")).To(Succeed())
+		Expect(r.Update(context.Background(), snapshot)).To(Succeed())
+
+		_, err = r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepStopping))
+		Expect(pg.Status.LastSuccessfulBackup).NotTo(BeNil())
+	})
+
+	It("should not retry a rolled back upgrade to the same version", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepRolledBack}
+		requeueAfter, err := reconciler().reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should scale the instance down before upgrading", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepStopping}
+		r := reconciler()
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*sts.Spec.Replicas).To(BeZero())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepUpgrading))
+	})
+
+	It("should roll back when pg_upgrade failed", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepUpgrading}
+		job := jobForUpgrade(pg, sts, DefaultUpgradeImage)
+		job.Status.Failed = 1
+		r := reconciler(job)
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepRollingBack))
+		Expect(pg.Status.Upgrade.Message).To(ContainSubstring(job.Name))
+	})
+
+	It("should roll back when the new version does not become ready", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepStarting,
+			StepTime: metav1.NewTime(time.Now().Add(-upgradeStartTimeout))}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"}}}
+		r := reconciler(pod)
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepRollingBack))
+		Expect(pg.Status.Upgrade.Message).To(ContainSubstring("did not become ready"))
+
+		// The new version is stopped before its data volume is restored
+		requeueAfter, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(upgradePollInterval))
+		Expect(*sts.Spec.Replicas).To(BeZero())
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepRollingBack))
+	})
+
+	It("should wait for the new version to become ready", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepStarting,
+			StepTime: metav1.Now()}
+		requeueAfter, err := reconciler().reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requeueAfter).To(Equal(upgradePollInterval))
+		Expect(pg.Status.Upgrade.Step).To(Equal(postgresv1beta1.UpgradeStepStarting))
+	})
+
+	It("should run pg_upgrade with the binaries of both versions", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13.2", ToVersion: "16", Step: postgresv1beta1.UpgradeStepUpgrading}
+		job := jobForUpgrade(pg, sts, reconciler().upgradeImage(pg))
+		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("tianon/postgres-upgrade:13-to-16"))
+		Expect(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("data-orders-0"))
+		Expect(*job.Spec.BackoffLimit).To(BeZero())
+		Expect(job.Spec.Template.Spec.RestartPolicy).To(Equal(corev1.RestartPolicyNever))
+	})
+
+	It("should pull the pg_upgrade image configured for the operator or the instance", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{FromVersion: "13", ToVersion: "16", Step: postgresv1beta1.UpgradeStepUpgrading}
+		r := reconciler()
+		r.UpgradeImage = "registry.example.com/pg-upgrade:{from}-{to}"
+		r.RegistryRewrites = map[string]string{"registry.example.com": "harbor.example.com/mirror"}
+		r.ImagePullSecrets = []string{"registry-credentials"}
+		Expect(r.upgradeImage(pg)).To(Equal("registry.example.com/pg-upgrade:13-16"))
+
+		_, err := r.reconcileUpgrade(context.Background(), pg, sts, sts, nil)
+		Expect(err).NotTo(HaveOccurred())
+		var job batchv1.Job
+		Expect(r.Get(context.Background(), types.NamespacedName{Name: "orders-upgrade", Namespace: "shop"}, &job)).To(Succeed())
+		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("harbor.example.com/mirror/pg-upgrade:13-16"))
+		Expect(job.Spec.Template.Spec.ImagePullSecrets).To(ConsistOf(corev1.LocalObjectReference{Name: "registry-credentials"}))
+
+		pg.Spec.PostgreSQL.UpgradeImage = "registry.example.com/postgres-upgrade:13-to-16-hardened"
+		Expect(r.upgradeImage(pg)).To(Equal("registry.example.com/postgres-upgrade:13-to-16-hardened"))
+	})
+})
@@ -0,0 +1,102 @@
+// Package guard implements the admission webhook that protects the objects holding the data of a
+// Postgres instance with deletion protection.
+package guard
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+// Path is where the guard webhook is served
+const Path = "/validate-postgres-owned"
+
+// dataClaimPattern matches the claims created from the volume claim template of an instance
+var dataClaimPattern = regexp.MustCompile(`^data-(.+)-[0-9]+$`)
+
+// The webhook only receives objects with the postgres.snappcloud.io/instance label, see the
+// objectSelector patch in config/webhook. failurePolicy is fail so the protection holds while the
+// operator is unavailable, unrelated StatefulSets and claims are not affected.
+//+kubebuilder:webhook:path=/validate-postgres-owned,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps;"",resources=statefulsets;persistentvolumeclaims,verbs=delete,versions=v1,name=vpostgresowned.kb.io,admissionReviewVersions=v1
+
+// OwnedResourceGuard rejects deleting the StatefulSet or a data volume claim of a Postgres
+// instance with deletion protection. Deletes are allowed once the instance itself is being deleted,
+// so the finalizer and the garbage collector can clean up, and while an upgrade is in progress.
+type OwnedResourceGuard struct {
+	Client  client.Reader
+	Decoder *admission.Decoder
+}
+
+var _ admission.Handler = &OwnedResourceGuard{}
+
+// Handle implements admission.Handler
+func (g *OwnedResourceGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Delete {
+		return admission.Allowed("")
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := g.Decoder.DecodeRaw(req.OldObject, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	name := instanceName(obj)
+	if name == "" {
+		return admission.Allowed("")
+	}
+
+	var pg postgresv1beta1.Postgres
+	if err := g.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: obj.GetNamespace()}, &pg); err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		logf.FromContext(ctx).Error(err, "Failed to get Postgres", "Postgres.Name", name)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !pg.Spec.Deletion.Protection || !pg.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	// Upgrades replace data volumes and remove the instance of a blue/green upgrade
+	if pg.Status.Upgrade.InProgress() {
+		return admission.Allowed("")
+	}
+	return admission.Denied(fmt.Sprintf("%s %s belongs to postgres %s which has deletion protection enabled",
+		obj.GetKind(), obj.GetName(), pg.Name))
+}
+
+// instanceName returns the name of the Postgres instance obj belongs to, or "" if it is not
+// operator managed
+func instanceName(obj *unstructured.Unstructured) string {
+	switch obj.GetKind() {
+	case "StatefulSet":
+		// StatefulSets created before v1beta1 are still owned through v1alpha1, so only the group counts
+		owner := metav1.GetControllerOf(obj)
+		if owner == nil || owner.Kind != "Postgres" || owner.Name != obj.GetName() {
+			return ""
+		}
+		if gv, err := schema.ParseGroupVersion(owner.APIVersion); err != nil || gv.Group != postgresv1beta1.GroupVersion.Group {
+			return ""
+		}
+		return owner.Name
+	case "PersistentVolumeClaim":
+		match := dataClaimPattern.FindStringSubmatch(obj.GetName())
+		if match == nil || obj.GetLabels()["app"] != match[1] {
+			return ""
+		}
+		return match[1]
+	}
+	return ""
+}
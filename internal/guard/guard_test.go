@@ -0,0 +1,114 @@
+package guard
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	postgresv1beta1 "github.com/rezacloner1372/postgresql-operator/api/v1beta1"
+)
+
+func TestGuard(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Guard Suite")
+}
+
+var _ = Describe("Owned resource guard", func() {
+	var (
+		scheme *runtime.Scheme
+		pg     *postgresv1beta1.Postgres
+	)
+
+	BeforeEach(func() {
+		scheme = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(postgresv1beta1.AddToScheme(scheme)).To(Succeed())
+		pg = &postgresv1beta1.Postgres{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop", UID: "1234"},
+			Spec:       postgresv1beta1.PostgresSpec{Deletion: postgresv1beta1.DeletionSpec{Protection: true}},
+		}
+	})
+
+	handle := func(obj client.Object) admission.Response {
+		guard := &OwnedResourceGuard{
+			Client:  fake.NewClientBuilder().WithScheme(scheme).WithObjects(pg).Build(),
+			Decoder: admission.NewDecoder(scheme),
+		}
+		raw, err := json.Marshal(obj)
+		Expect(err).NotTo(HaveOccurred())
+		return guard.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Delete,
+			OldObject: runtime.RawExtension{Raw: raw},
+		}})
+	}
+
+	statefulSet := func() *appsv1.StatefulSet {
+		sts := &appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "shop"},
+		}
+		controller := true
+		sts.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: postgresv1beta1.GroupVersion.String(),
+			Kind:       "Postgres",
+			Name:       pg.Name,
+			UID:        pg.UID,
+			Controller: &controller,
+		}}
+		return sts
+	}
+
+	It("should deny deleting the StatefulSet of a protected instance", func() {
+		Expect(handle(statefulSet()).Allowed).To(BeFalse())
+	})
+
+	It("should deny deleting a StatefulSet owned through v1alpha1", func() {
+		sts := statefulSet()
+		sts.OwnerReferences[0].APIVersion = "postgres.snappcloud.io/v1alpha1"
+		Expect(handle(sts).Allowed).To(BeFalse())
+	})
+
+	It("should deny deleting a data volume of a protected instance", func() {
+		pvc := &corev1.PersistentVolumeClaim{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+			ObjectMeta: metav1.ObjectMeta{Name: "data-orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"}},
+		}
+		Expect(handle(pvc).Allowed).To(BeFalse())
+	})
+
+	It("should allow deletes while an upgrade is in progress", func() {
+		pg.Status.Upgrade = &postgresv1beta1.UpgradeStatus{Step: postgresv1beta1.UpgradeStepRollingBack}
+		Expect(handle(statefulSet()).Allowed).To(BeTrue())
+	})
+
+	It("should allow deleting the StatefulSet of a blue/green upgrade", func() {
+		sts := statefulSet()
+		sts.Name = "orders-green"
+		Expect(handle(sts).Allowed).To(BeTrue())
+	})
+
+	It("should allow deletes once protection is disabled", func() {
+		pg.Spec.Deletion.Protection = false
+		Expect(handle(statefulSet()).Allowed).To(BeTrue())
+	})
+
+	It("should allow deleting unrelated objects", func() {
+		pvc := &corev1.PersistentVolumeClaim{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+			ObjectMeta: metav1.ObjectMeta{Name: "scratch", Namespace: "shop"},
+		}
+		Expect(handle(pvc).Allowed).To(BeTrue())
+	})
+})